@@ -1,16 +1,46 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
 	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/gob"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
+	"math"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
+
+	"github.com/gorilla/websocket"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 // --- TYPES ---
@@ -19,15 +49,37 @@ type Block struct {
 	Index        int           `json:"index"`
 	Timestamp    string        `json:"timestamp"`
 	Transactions []Transaction `json:"transactions"`
+	MerkleRoot   string        `json:"merkle_root"`
 	PrevHash     string        `json:"prev_hash"`
+	Nonce        int           `json:"nonce"`
+	Difficulty   int           `json:"difficulty"`
 	Hash         string        `json:"hash"`
-	ValidatorSig string        `json:"validator_sig"`
+	// ValidatorSigs holds one signature over Hash per signing validator
+	ValidatorSigs []ValidatorSig `json:"validator_sigs"`
+}
+
+// ValidatorSig is a validator's signature over a block hash
+type ValidatorSig struct {
+	Validator string `json:"validator"`
+	Sig       string `json:"sig"`
 }
 
 type Transaction struct {
 	ID      string `json:"id"`
 	Payload string `json:"payload"`
 	Fee     int    `json:"fee"`
+
+	// PubKey is the sender's base64 Ed25519 public key. Nonce is the sender's
+	// sequence number; each must exceed the last one committed for that sender.
+	PubKey string `json:"pub_key,omitempty"`
+	Nonce  int    `json:"nonce,omitempty"`
+	// Sig is the sender's base64 Ed25519 signature, see transactionSigningBytes
+	Sig string `json:"sig,omitempty"`
+
+	// Coinbase marks the block reward transaction. Its Payload names the
+	// validator being credited and Amount is the reward.
+	Coinbase bool `json:"coinbase,omitempty"`
+	Amount   int  `json:"amount,omitempty"`
 }
 
 // ValidatorInterface allows easy mocking for tests
@@ -38,170 +90,2350 @@ type ValidatorInterface interface {
 
 // Concrete Validator implementation
 type ValidatorNode struct {
-	Name      string
+	Name string
+	// PublicKey is the validator's base64-encoded Ed25519 public key
+	PublicKey string
+
+	// Keys rotated out of service, oldest first. Kept so blocks signed
+	// just before a rotation still verify during KeyGraceWindow, and so
+	// older blocks in a peer's chain still verify during sync.
+	KeyHistory []RetiredKey
+	keyMu      sync.RWMutex
+
+	// active is false once a validator is taken out of the signing set;
+	// deactivatedAt records when, so blocks it signed before then still count
+	active        bool
+	deactivatedAt time.Time
+}
+
+// RetiredKey is a validator key that has been replaced by a newer one
+type RetiredKey struct {
 	PublicKey string
+	RetiredAt time.Time
 }
 
+// --- KEY ROTATION SETTINGS ---
+var (
+	// KeyGraceWindow is how long a rotated-out key keeps verifying in-flight blocks
+	KeyGraceWindow = 10 * time.Minute
+	// MaxKeyHistory bounds how many retired keys are remembered per validator. Blocks
+	// signed with a key older than that only verify if the local chain already holds them.
+	MaxKeyHistory = 3
+)
+
+// ShutdownTimeout bounds how long in-flight requests may run after SIGTERM
+const ShutdownTimeout = 30 * time.Second
+
 // --- GLOBAL STATE ---
 var (
 	blockchain []Block
-	mutex      sync.Mutex
+	// txIndex maps each committed transaction ID to the index of its block
+	txIndex map[string]int
+	// senderNonces holds the highest committed nonce for each sender
+	senderNonces map[string]int
+	mutex        sync.RWMutex // guards blockchain and its indexes; readers take RLock
 )
 
-// --- HELPERS ---
+// reindexChain rebuilds txIndex and senderNonces from blockchain. The caller must hold mutex.
+func reindexChain() {
+	txIndex = indexTransactions(blockchain)
+	senderNonces = make(map[string]int)
+	for _, b := range blockchain {
+		for _, t := range b.Transactions {
+			if !t.Coinbase {
+				senderNonces[t.PubKey] = t.Nonce
+			}
+		}
+	}
+}
 
-func calculateHash(b Block) string {
-	record := fmt.Sprintf("%d%s%s", b.Index, b.Timestamp, b.PrevHash)
-	h := sha256.New()
-	h.Write([]byte(record))
-	return hex.EncodeToString(h.Sum(nil))
+// checkNonces verifies each sender's nonces in txs increase past the last one in
+// nonces, recording the new highs in nonces as it goes.
+func checkNonces(txs []Transaction, nonces map[string]int) error {
+	for i, t := range txs {
+		if t.Coinbase {
+			continue
+		}
+		if t.Nonce <= nonces[t.PubKey] {
+			return fmt.Errorf("transaction %d: nonce %d already used by sender", i, t.Nonce)
+		}
+		nonces[t.PubKey] = t.Nonce
+	}
+	return nil
 }
 
-// MerkleRoot calculates the root hash of transactions
-// Implements standard Merkle Tree logic
-func MerkleRoot(txs []Transaction) string {
-	if len(txs) == 0 {
-		return ""
+// indexTransactions builds the transaction ID index for chain
+func indexTransactions(chain []Block) map[string]int {
+	index := make(map[string]int)
+	for _, b := range chain {
+		for _, t := range b.Transactions {
+			index[t.ID] = b.Index
+		}
 	}
-	var hashes []string
+	return index
+}
+
+// duplicateTransaction returns the first ID in txs that repeats within txs or
+// already appears in committed. The caller must hold mutex if committed is txIndex.
+func duplicateTransaction(txs []Transaction, committed map[string]int) (string, bool) {
+	seen := make(map[string]bool, len(txs))
 	for _, t := range txs {
-		h := sha256.Sum256([]byte(t.ID + t.Payload))
-		hashes = append(hashes, hex.EncodeToString(h[:]))
+		if _, ok := committed[t.ID]; ok || seen[t.ID] {
+			return t.ID, true
+		}
+		seen[t.ID] = true
 	}
+	return "", false
+}
 
-	for len(hashes) > 1 {
-		var newLevel []string
-		if len(hashes)%2 != 0 {
-			hashes = append(hashes, hashes[len(hashes)-1])
+// Genesis block parameters. They are fixed so every node derives the same genesis hash.
+const (
+	GenesisTimestamp = "2024-01-01T00:00:00Z"
+	GenesisPrevHash  = "0000000000000000000000000000000000000000000000000000000000000000"
+)
+
+// initChain anchors the chain with the deterministic genesis block
+func initChain() {
+	genesis := Block{
+		Index:        0,
+		Timestamp:    GenesisTimestamp,
+		Transactions: []Transaction{},
+		PrevHash:     GenesisPrevHash,
+	}
+	genesis.Hash = calculateHash(genesis)
+
+	mutex.Lock()
+	blockchain = []Block{genesis}
+	reindexChain()
+	mutex.Unlock()
+}
+
+// --- PERSISTENCE ---
+
+// chainPath is where the chain is persisted; empty disables persistence
+var chainPath = "chain.json"
+
+// saveChain writes the chain to path. The caller must hold mutex.
+// The file is written beside the target and renamed so a crash never leaves a torn chain.
+func saveChain(path string) error {
+	if path == "" {
+		return nil
+	}
+	data, err := json.Marshal(blockchain)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// loadChain replaces the in-memory chain with the one stored at path,
+// falling back to genesis when no file exists yet.
+func loadChain(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		initChain()
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var chain []Block
+	if err := json.Unmarshal(data, &chain); err != nil {
+		return fmt.Errorf("decode %s: %w", path, err)
+	}
+	if len(chain) == 0 {
+		return fmt.Errorf("%s holds an empty chain", path)
+	}
+	if index, err := validateChain(chain); err != nil {
+		return fmt.Errorf("%s: block %d: %w", path, index, err)
+	}
+
+	mutex.Lock()
+	blockchain = chain
+	reindexChain()
+	mutex.Unlock()
+	return nil
+}
+
+// --- FORK RESOLUTION ---
+
+// MaxChainBytes bounds the size of a candidate chain accepted over HTTP
+var MaxChainBytes int64 = 64 << 20
+
+var (
+	errChainNotLonger = errors.New("candidate chain is not longer than the local chain")
+	errPersistChain   = errors.New("failed to persist chain")
+)
+
+// replaceChain adopts a chain from another node if it is strictly longer than the
+// local chain (longest-chain rule)
+func replaceChain(candidate []Block) (int, error) {
+	return adoptChain(candidate, true)
+}
+
+// adoptChain swaps in candidate if it is valid, shares our genesis block, and every
+// block it does not share with the local chain carries a quorum of validator
+// signatures. Shared blocks were checked when we accepted them; rechecking them
+// against today's registry would reject every chain after a key rotation. With
+// requireLonger the candidate must also be strictly longer than the local chain.
+// Transactions from dropped blocks that the candidate does not contain go back to the mempool.
+func adoptChain(candidate []Block, requireLonger bool) (int, error) {
+	if len(candidate) == 0 {
+		return 0, errors.New("candidate chain is empty")
+	}
+	if index, err := validateChain(candidate); err != nil {
+		return 0, fmt.Errorf("block %d: %w", index, err)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if candidate[0].Hash != blockchain[0].Hash {
+		return 0, errors.New("candidate chain has a different genesis block")
+	}
+	if requireLonger && len(candidate) <= len(blockchain) {
+		return 0, errChainNotLonger
+	}
+	shared := 1
+	for shared < len(candidate) && shared < len(blockchain) && candidate[shared].Hash == blockchain[shared].Hash {
+		shared++
+	}
+	for _, b := range candidate[shared:] {
+		if quorumSigners(b, true) < Quorum {
+			return 0, fmt.Errorf("block %d: fewer than %d validator signatures", b.Index, Quorum)
 		}
-		for i := 0; i < len(hashes); i += 2 {
-			// VULNERABILITY (Cryptographic Logic):
-			// Concatenation H(a)+H(b) allows for Second Preimage Attacks (Leaf-Node confusion).
-			// If an attacker can create a transaction with ID = Hash(A) + Hash(B), 
-			// they can fool the verifier into accepting a fake tree branch.
-			// Correct implementation should prepend distinct prefixes for leaves vs nodes.
-			combined := hashes[i] + hashes[i+1]
-			hash := sha256.Sum256([]byte(combined))
-			newLevel = append(newLevel, hex.EncodeToString(hash[:]))
+	}
+
+	previous := blockchain
+	blockchain = candidate
+	if err := saveChain(chainPath); err != nil {
+		blockchain = previous
+		log.Printf("Persist error: %v", err)
+		return 0, errPersistChain
+	}
+	reindexChain()
+
+	mempoolMu.Lock()
+	pending := make(map[string]bool, len(mempool))
+	for _, t := range mempool {
+		pending[t.ID] = true
+	}
+	var orphaned []Transaction
+	for _, b := range previous {
+		for _, t := range b.Transactions {
+			if !pending[t.ID] && !t.Coinbase {
+				orphaned = append(orphaned, t)
+			}
 		}
-		hashes = newLevel
 	}
-	return hashes[0]
+	mempool = append(orphaned, mempool...)
+	mempoolMu.Unlock()
+	pruneMempool()
+
+	return len(candidate), nil
 }
 
-// --- VALIDATION LOGIC ---
+// --- EXPORT / IMPORT ---
+// The gob format is a sequence of records, each a 4-byte big-endian length
+// followed by one gob-encoded Block, so either side can stream block by block.
 
-func (v *ValidatorNode) IsActive() bool {
-	// Logic to check if validator is in the active set
-	return true
+func writeGobBlock(w io.Writer, b Block) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(b); err != nil {
+		return err
+	}
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(buf.Len()))
+	if _, err := w.Write(size[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
 }
 
-// ValidateBlock implements the interface
-func (v *ValidatorNode) ValidateBlock(b Block) bool {
-	// VULNERABILITY (Typed Nil Bypass):
-	// If 'v' is a nil pointer, this method can still be called in Go without panicking 
-	// (unlike Java/C++). 
-	// The developer assumes "If I am nil, I am not a specific bad actor, so I default to safe".
-	// However, if the lookup returns a nil pointer but the interface wrapper is non-nil,
-	// this method executes.
-	if v == nil {
-		// Logically: "If no validator logic exists, assume block is valid to prevent chain halt"
-		// Security Reality: Allows signature bypass if we can force the system to retrieve a nil validator.
-		return true 
+// readGobBlock reads one record, returning io.EOF when the stream ends cleanly
+func readGobBlock(r io.Reader) (Block, error) {
+	var b Block
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return b, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if int64(n) > MaxBlockBytes {
+		return b, fmt.Errorf("block record of %d bytes exceeds limit", n)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return b, io.ErrUnexpectedEOF
+	}
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&b)
+	if b.Transactions == nil {
+		b.Transactions = []Transaction{} // gob does not distinguish empty from nil
 	}
-	
-	// Real signature check omitted for brevity
-	return b.Hash == calculateHash(b)
+	return b, err
 }
 
-// LookupValidator simulates a DB lookup
-func LookupValidator(name string) (*ValidatorNode, error) {
-	if name == "trusted_node" {
-		return &ValidatorNode{Name: "trusted", PublicKey: "KEY123"}, nil
+// readJSONChain decodes a JSON array of blocks one element at a time
+func readJSONChain(r io.Reader) ([]Block, error) {
+	dec := json.NewDecoder(r)
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+		return nil, errors.New("expected a JSON array of blocks")
 	}
-	// If not found, returns nil pointer and error
-	return nil, errors.New("validator not found")
+	var chain []Block
+	for dec.More() {
+		var b Block
+		if err := dec.Decode(&b); err != nil {
+			return nil, err
+		}
+		chain = append(chain, b)
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+	return chain, nil
 }
 
-// --- HANDLERS ---
+// --- PEER SYNC ---
 
-func HandleProposeBlock(w http.ResponseWriter, r *http.Request) {
-	var newBlock Block
-	if err := json.NewDecoder(r.Body).Decode(&newBlock); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
+var (
+	// SyncInterval is how often syncWithPeers polls the registered peers
+	SyncInterval = 30 * time.Second
+
+	peers      []string
+	peersMu    sync.RWMutex
+	peerClient = &http.Client{Timeout: 10 * time.Second}
+)
+
+// AddPeer registers a peer node by its base URL, e.g. http://10.0.0.2:8081
+func AddPeer(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid peer URL %q", rawURL)
 	}
+	base := strings.TrimRight(u.String(), "/")
 
-	// 1. ACCESS CONTROL
-	// Default access level is 0 (Admin/SuperUser)
-	// We want to restrict this to Level 1 (Guest) unless authenticated.
-	accessLevel := 0 
-	
-	apiKey := r.Header.Get("X-API-Key")
-	if apiKey == "" {
-		accessLevel = 1 // Downgrade to Guest
-	} else {
-		// VULNERABILITY (Variable Shadowing):
-		// The developer uses `:=` which declares a NEW 'accessLevel' variable 
-		// scoped only to this 'else' block.
-		// The OUTER 'accessLevel' variable remains 0 (Admin).
-		// If checkApiKey fails, the outer 0 remains, granting Admin access by default logic below.
-		accessLevel, err := checkApiKey(apiKey) 
+	peersMu.Lock()
+	defer peersMu.Unlock()
+	for _, p := range peers {
+		if p == base {
+			return nil
+		}
+	}
+	peers = append(peers, base)
+	return nil
+}
+
+// fetchPeerChain downloads a peer's full chain
+func fetchPeerChain(ctx context.Context, peer string) ([]Block, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, peer+"/chain", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := peerClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var chain []Block
+	if err := json.NewDecoder(io.LimitReader(resp.Body, MaxChainBytes)).Decode(&chain); err != nil {
+		return nil, err
+	}
+	return chain, nil
+}
+
+// syncWithPeers fetches every peer's chain and adopts the longest valid one
+func syncWithPeers(ctx context.Context) {
+	peersMu.RLock()
+	targets := append([]string(nil), peers...)
+	peersMu.RUnlock()
+
+	type candidate struct {
+		peer  string
+		chain []Block
+	}
+	var candidates []candidate
+	for _, p := range targets {
+		chain, err := fetchPeerChain(ctx, p)
 		if err != nil {
-			// Logging error but continuing... 
-			log.Printf("Auth error: %v", err)
-			// Flow continues. The inner accessLevel is discarded.
-		} else {
-			// Even if success, this inner variable is discarded after the `else` block closes.
-			_ = accessLevel 
+			log.Printf("Sync: fetch from %s failed: %v", p, err)
+			continue
 		}
+		candidates = append(candidates, candidate{p, chain})
 	}
 
-	// Logic check: Only Admin (0) can propose blocks.
-	// Due to shadowing, if apiKey is provided (even invalid), code enters 'else', 
-	// shadows variable, exits 'else', and outer accessLevel is still 0.
-	if accessLevel > 0 {
-		http.Error(w, "Unauthorized: Only Admins can propose blocks", http.StatusForbidden)
+	// Longest first, so the first chain replaceChain accepts is the longest valid one
+	sort.Slice(candidates, func(i, j int) bool { return len(candidates[i].chain) > len(candidates[j].chain) })
+	for _, c := range candidates {
+		height, err := replaceChain(c.chain)
+		if errors.Is(err, errChainNotLonger) {
+			return
+		}
+		if err != nil {
+			log.Printf("Sync: rejected chain from %s: %v", c.peer, err)
+			continue
+		}
+		log.Printf("Sync: adopted chain from %s at height %d", c.peer, height)
 		return
 	}
+}
 
-	// 2. VALIDATION
-	validatorName := r.Header.Get("X-Validator-ID")
-	
-	// Returns a pointer (which might be nil) and an error
-	valPtr, _ := LookupValidator(validatorName)
-	
-	// We wrap the pointer in the interface.
-	// If valPtr is nil, 'validator' is a "Typed Nil" (non-nil interface holding a nil pointer).
-	var validator ValidatorInterface = valPtr
-	
-	// Go quirk: (validator != nil) is TRUE even if valPtr is nil.
-	if validator != nil {
-		// This calls (*ValidatorNode).ValidateBlock(b) on a nil receiver.
-		// As seen above, that method returns 'true' for nil receivers.
-		if !validator.ValidateBlock(newBlock) {
-			http.Error(w, "Block validation failed", http.StatusBadRequest)
+// runPeerSync calls syncWithPeers every SyncInterval until ctx is cancelled
+func runPeerSync(ctx context.Context) {
+	ticker := time.NewTicker(SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
 			return
+		case <-ticker.C:
+			syncWithPeers(ctx)
 		}
 	}
+}
 
-	// 3. COMMIT
-	mutex.Lock()
-	blockchain = append(blockchain, newBlock)
-	mutex.Unlock()
+// --- PROOF OF WORK ---
 
-	w.WriteHeader(http.StatusCreated)
-	fmt.Fprintln(w, "Block accepted")
+// Difficulty is the number of leading zero hex digits a block hash needs. Each block
+// records the difficulty it was mined at; Difficulty is the starting value that
+// retargeting adjusts from.
+var Difficulty = 4
+
+// Retargeting settings
+var (
+	// RetargetInterval is how many blocks pass between difficulty adjustments
+	RetargetInterval = 10
+	// TargetBlockTime is the intended time between blocks
+	TargetBlockTime = 30 * time.Second
+	// MinDifficulty and MaxDifficulty bound retargeting
+	MinDifficulty = 1
+	MaxDifficulty = 8
+)
+
+// hasProofOfWork reports whether hash meets the given difficulty
+func hasProofOfWork(hash string, difficulty int) bool {
+	return difficulty >= 0 && difficulty <= len(hash) && strings.Count(hash[:difficulty], "0") == difficulty
 }
 
-func checkApiKey(key string) (int, error) {
-	if key == "secret_admin" {
-		return 0, nil // Admin
+// nextDifficulty returns the difficulty required of the block after chain. Every
+// RetargetInterval blocks it compares how long the last interval took with the
+// target and moves one step: up when blocks came in under half the target time,
+// down when they took more than double. One hex digit is already a 16x change in
+// work, so a single step per interval keeps adjustments from swinging wildly.
+func nextDifficulty(chain []Block) int {
+	prev := chain[len(chain)-1]
+	current := prev.Difficulty
+	if prev.Index == 0 {
+		current = Difficulty
+	}
+
+	index := len(chain)
+	if index%RetargetInterval != 0 || index < RetargetInterval+1 {
+		return current
 	}
-	return 1, errors.New("invalid key") // Guest
+	start, err1 := time.Parse(time.RFC3339, chain[index-RetargetInterval].Timestamp)
+	end, err2 := time.Parse(time.RFC3339, prev.Timestamp)
+	if err1 != nil || err2 != nil {
+		return current
+	}
+
+	expected := time.Duration(RetargetInterval-1) * TargetBlockTime
+	switch elapsed := end.Sub(start); {
+	case elapsed < expected/2 && current < MaxDifficulty:
+		current++
+	case elapsed > expected*2 && current > MinDifficulty:
+		current--
+	}
+	return current
 }
 
-func main() {
-	http.HandleFunc("/block/propose", HandleProposeBlock)
-	log.Fatal(http.ListenAndServe(":8081", nil))
-}
\ No newline at end of file
+// mineBlock increments the nonce until the block hash meets difficulty
+func mineBlock(b Block, difficulty int) Block {
+	b.Difficulty = difficulty
+	for b.Nonce = 0; ; b.Nonce++ {
+		b.Hash = calculateHash(b)
+		if hasProofOfWork(b.Hash, difficulty) {
+			return b
+		}
+	}
+}
+
+// --- BLOCK LIMITS ---
+var (
+	// MaxBlockBytes bounds the size of a proposed block's JSON body
+	MaxBlockBytes int64 = 1 << 20
+	// MaxBlockTxCount bounds how many transactions a block may carry
+	MaxBlockTxCount = 1000
+	// AllowEmptyBlocks controls whether blocks without transactions are accepted
+	AllowEmptyBlocks = true
+	// MaxClockSkew is how far ahead of server time a block timestamp may be
+	MaxClockSkew = 2 * time.Minute
+)
+
+// --- BLOCK REWARD ---
+
+// BlockSubsidy is the fixed reward a validator earns per block, on top of its fees
+var BlockSubsidy = 50
+
+// MaxFee caps a single transaction's fee. Fees are summed into the coinbase amount,
+// and at this cap even billions of transactions can't overflow it.
+var MaxFee = 1000000000
+
+// coinbaseIDPrefix starts every coinbase ID; user transactions may not use it, or
+// one committed early would collide with that block's required coinbase
+const coinbaseIDPrefix = "coinbase-"
+
+// coinbaseTransaction builds the reward transaction crediting validator for a block
+// at index containing txs
+func coinbaseTransaction(validator string, index int, txs []Transaction) Transaction {
+	reward := BlockSubsidy
+	for _, t := range txs {
+		reward += t.Fee
+	}
+	return Transaction{
+		ID:       fmt.Sprintf("%s%d", coinbaseIDPrefix, index),
+		Payload:  validator,
+		Coinbase: true,
+		Amount:   reward,
+	}
+}
+
+// checkCoinbase verifies b starts with exactly one coinbase transaction paying the
+// subsidy plus the block's fees, and returns the credited validator.
+func checkCoinbase(b Block) (string, error) {
+	if len(b.Transactions) == 0 || !b.Transactions[0].Coinbase {
+		return "", errors.New("first transaction must be the coinbase")
+	}
+	for _, t := range b.Transactions[1:] {
+		if t.Coinbase {
+			return "", errors.New("block has more than one coinbase")
+		}
+	}
+	cb := b.Transactions[0]
+	want := coinbaseTransaction(cb.Payload, b.Index, b.Transactions[1:])
+	if cb != want {
+		return "", fmt.Errorf("coinbase must be %q paying %d", want.ID, want.Amount)
+	}
+	return cb.Payload, nil
+}
+
+// --- MEMPOOL ---
+
+// MaxTxPerBlock caps how many mempool transactions go into an assembled block.
+// It should not exceed MaxBlockTxCount.
+var MaxTxPerBlock = 100
+
+var (
+	// MaxMempoolSize caps how many transactions wait in the mempool
+	MaxMempoolSize = 10000
+	// MaxTxBytes bounds the size of a submitted transaction's JSON body
+	MaxTxBytes int64 = 16 << 10
+	// MaxRequestBytes bounds the JSON body of small admin requests
+	MaxRequestBytes int64 = 16 << 10
+)
+
+var (
+	mempool   []Transaction
+	mempoolMu sync.Mutex
+)
+
+// assembleBlock builds an unsigned, unmined candidate block on top of the current tip,
+// taking the highest-fee transactions from the mempool behind a coinbase crediting
+// validator. Transactions stay in the mempool until a block containing them is committed.
+func assembleBlock(validator string) Block {
+	mempoolMu.Lock()
+	pending := make([]Transaction, len(mempool))
+	copy(pending, mempool)
+	mempoolMu.Unlock()
+
+	// Queue each sender's transactions in nonce order. Selection then takes the
+	// highest-fee transaction at the head of any queue, so fees decide the order
+	// across senders without a high-fee, high-nonce transaction jumping ahead of
+	// its sender's earlier ones.
+	sort.SliceStable(pending, func(i, j int) bool { return pending[i].Nonce < pending[j].Nonce })
+
+	mutex.RLock()
+	tip := blockchain[len(blockchain)-1]
+	difficulty := nextDifficulty(blockchain)
+	var senders []string
+	queues := make(map[string][]Transaction)
+	nonces := make(map[string]int)
+	for _, t := range pending {
+		if _, committed := txIndex[t.ID]; committed {
+			continue
+		}
+		if _, ok := queues[t.PubKey]; !ok {
+			senders = append(senders, t.PubKey)
+			nonces[t.PubKey] = senderNonces[t.PubKey]
+		}
+		queues[t.PubKey] = append(queues[t.PubKey], t)
+	}
+	mutex.RUnlock()
+
+	selected := []Transaction{}
+	seen := make(map[string]bool)
+	for len(selected) < MaxTxPerBlock {
+		best := ""
+		for _, sender := range senders {
+			q := queues[sender]
+			if len(q) > 0 && (best == "" || q[0].Fee > queues[best][0].Fee) {
+				best = sender
+			}
+		}
+		if best == "" {
+			break
+		}
+		t := queues[best][0]
+		queues[best] = queues[best][1:]
+		if seen[t.ID] || checkNonces([]Transaction{t}, nonces) != nil {
+			continue
+		}
+		seen[t.ID] = true
+		selected = append(selected, t)
+	}
+
+	txs := append([]Transaction{coinbaseTransaction(validator, tip.Index+1, selected)}, selected...)
+	b := Block{
+		Index:        tip.Index + 1,
+		Timestamp:    time.Now().UTC().Format(time.RFC3339),
+		Transactions: txs,
+		MerkleRoot:   MerkleRoot(txs),
+		PrevHash:     tip.Hash,
+		Difficulty:   difficulty,
+	}
+	b.Hash = calculateHash(b)
+	return b
+}
+
+// pruneMempool drops transactions that are already committed or whose nonce
+// has been overtaken by a committed one. The caller must hold mutex.
+func pruneMempool() {
+	mempoolMu.Lock()
+	defer mempoolMu.Unlock()
+	kept := mempool[:0]
+	for _, t := range mempool {
+		if _, committed := txIndex[t.ID]; !committed && t.Nonce > senderNonces[t.PubKey] {
+			kept = append(kept, t)
+		}
+	}
+	mempool = kept
+}
+
+// --- HELPERS ---
+
+// canonicalWriter feeds fields to a hash in a fixed binary encoding: integers as
+// 8 bytes big-endian and strings length-prefixed, so field boundaries are
+// unambiguous and every node hashes identical values to identical bytes.
+type canonicalWriter struct {
+	w io.Writer
+}
+
+func (c canonicalWriter) int(n int) {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(int64(n)))
+	c.w.Write(buf[:])
+}
+
+func (c canonicalWriter) str(s string) {
+	c.int(len(s))
+	io.WriteString(c.w, s)
+}
+
+func (c canonicalWriter) bool(b bool) {
+	if b {
+		c.w.Write([]byte{1})
+	} else {
+		c.w.Write([]byte{0})
+	}
+}
+
+// calculateHash commits to the block header and, through the stored Merkle root, to
+// every transaction. ValidatorSigs are left out: they are computed over this hash, so
+// they cannot also be an input to it. Fields are written in a fixed order; a new
+// field is only hashed once it is added here.
+func calculateHash(b Block) string {
+	h := sha256.New()
+	cw := canonicalWriter{h}
+	cw.int(b.Index)
+	cw.str(b.Timestamp)
+	cw.str(b.PrevHash)
+	cw.str(b.MerkleRoot)
+	cw.int(b.Nonce)
+	cw.int(b.Difficulty)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Domain separation prefixes for Merkle hashing (as in RFC 6962). A leaf hash can
+// never equal an internal node hash, so a transaction crafted to look like two
+// child hashes does not produce a colliding root.
+const (
+	merkleLeafPrefix = 0x00
+	merkleNodePrefix = 0x01
+)
+
+// merkleLeafHash commits to every field of t, so fees and rewards cannot be
+// altered without changing the root.
+func merkleLeafHash(t Transaction) []byte {
+	h := sha256.New()
+	h.Write([]byte{merkleLeafPrefix})
+	cw := canonicalWriter{h}
+	cw.str(t.ID)
+	cw.str(t.Payload)
+	cw.int(t.Fee)
+	cw.str(t.PubKey)
+	cw.int(t.Nonce)
+	cw.bool(t.Coinbase)
+	cw.int(t.Amount)
+	return h.Sum(nil)
+}
+
+func merkleNodeHash(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{merkleNodePrefix})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// merkleNextLevel pairs up the hashes of one tree level.
+// A lone node at the end of an odd-sized level is promoted to the next level
+// unchanged rather than paired with a copy of itself; duplicating it would give
+// [a, b, c] and [a, b, c, c] the same root.
+func merkleNextLevel(hashes [][]byte) [][]byte {
+	var next [][]byte
+	for i := 0; i+1 < len(hashes); i += 2 {
+		next = append(next, merkleNodeHash(hashes[i], hashes[i+1]))
+	}
+	if len(hashes)%2 != 0 {
+		next = append(next, hashes[len(hashes)-1])
+	}
+	return next
+}
+
+// MerkleRoot calculates the root hash of transactions
+func MerkleRoot(txs []Transaction) string {
+	if len(txs) == 0 {
+		return ""
+	}
+	var hashes [][]byte
+	for _, t := range txs {
+		hashes = append(hashes, merkleLeafHash(t))
+	}
+
+	for len(hashes) > 1 {
+		hashes = merkleNextLevel(hashes)
+	}
+	return hex.EncodeToString(hashes[0])
+}
+
+// ProofStep is one sibling on the path from a leaf to the Merkle root.
+// Left reports whether the sibling sits to the left of the running hash.
+type ProofStep struct {
+	Hash string `json:"hash"`
+	Left bool   `json:"left"`
+}
+
+// MerkleProof returns the inclusion proof for txs[index], ordered leaf to root.
+// Levels where the node is promoted without a sibling contribute no step.
+func MerkleProof(txs []Transaction, index int) ([]ProofStep, error) {
+	if index < 0 || index >= len(txs) {
+		return nil, fmt.Errorf("index %d out of range for %d transactions", index, len(txs))
+	}
+	var hashes [][]byte
+	for _, t := range txs {
+		hashes = append(hashes, merkleLeafHash(t))
+	}
+
+	var proof []ProofStep
+	for len(hashes) > 1 {
+		sibling := index ^ 1
+		if sibling < len(hashes) {
+			proof = append(proof, ProofStep{Hash: hex.EncodeToString(hashes[sibling]), Left: sibling < index})
+		}
+
+		hashes = merkleNextLevel(hashes)
+		index /= 2
+	}
+	return proof, nil
+}
+
+// VerifyMerkleProof recomputes the root from txLeaf and its proof and compares it to root
+func VerifyMerkleProof(txLeaf Transaction, proof []ProofStep, root string) bool {
+	want, err := hex.DecodeString(root)
+	if err != nil {
+		return false
+	}
+	hash := merkleLeafHash(txLeaf)
+	for _, step := range proof {
+		sibling, err := hex.DecodeString(step.Hash)
+		if err != nil || len(sibling) != sha256.Size {
+			return false
+		}
+		if step.Left {
+			hash = merkleNodeHash(sibling, hash)
+		} else {
+			hash = merkleNodeHash(hash, sibling)
+		}
+	}
+	return subtle.ConstantTimeCompare(hash, want) == 1
+}
+
+// --- VALIDATION LOGIC ---
+
+// transactionSigningBytes is what a sender signs: the canonical encoding of ID,
+// Payload and Fee, plus PubKey and Nonce so a signature cannot be replayed under
+// another sender or sequence number.
+func transactionSigningBytes(t Transaction) []byte {
+	var buf bytes.Buffer
+	cw := canonicalWriter{&buf}
+	cw.str(t.ID)
+	cw.str(t.Payload)
+	cw.int(t.Fee)
+	cw.str(t.PubKey)
+	cw.int(t.Nonce)
+	return buf.Bytes()
+}
+
+// SignTransaction returns the base64 signature for t under the sender's key
+func SignTransaction(t Transaction, key ed25519.PrivateKey) string {
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(key, transactionSigningBytes(t)))
+}
+
+func transactionSignatureValid(t Transaction) bool {
+	pub, err := base64.StdEncoding.DecodeString(t.PubKey)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return false
+	}
+	sig, err := base64.StdEncoding.DecodeString(t.Sig)
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return false
+	}
+	return ed25519.Verify(ed25519.PublicKey(pub), transactionSigningBytes(t), sig)
+}
+
+// validateTransaction checks the fields every transaction must carry and, for
+// anything but the coinbase, the sender's signature
+func validateTransaction(t Transaction) error {
+	switch {
+	case t.ID == "":
+		return errors.New("id is required")
+	case t.Payload == "":
+		return errors.New("payload is required")
+	case t.Fee < 0:
+		return errors.New("fee must not be negative")
+	case t.Fee > MaxFee:
+		return fmt.Errorf("fee must not exceed %d", MaxFee)
+	case !t.Coinbase && strings.HasPrefix(t.ID, coinbaseIDPrefix):
+		return fmt.Errorf("id prefix %q is reserved for coinbase transactions", coinbaseIDPrefix)
+	case !t.Coinbase && t.PubKey == "":
+		return errors.New("pub_key is required")
+	case !t.Coinbase && !transactionSignatureValid(t):
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
+// validateBlockFields rejects a block whose required fields are missing or whose
+// hash does not match its contents, naming the offending field
+func validateBlockFields(b Block) error {
+	switch {
+	case b.Timestamp == "":
+		return errors.New("timestamp is required")
+	case b.PrevHash == "":
+		return errors.New("prev_hash is required")
+	case b.Hash == "":
+		return errors.New("hash is required")
+	case b.Hash != calculateHash(b):
+		return errors.New("hash does not match block contents")
+	}
+	return nil
+}
+
+// validateChain checks that chain is a self-consistent sequence of blocks starting
+// from genesis. It returns the index of the first invalid block and why it is invalid,
+// or -1 and nil. Block hashes commit to the Merkle root, so a hash match also means
+// the transactions are the ones the block was built with.
+func validateChain(chain []Block) (int, error) {
+	seen := make(map[string]int)
+	nonces := make(map[string]int)
+	for i, b := range chain {
+		if b.Index != i {
+			return i, fmt.Errorf("index %d at position %d", b.Index, i)
+		}
+		if i == 0 {
+			if b.PrevHash != GenesisPrevHash {
+				return i, errors.New("genesis block has a non-zero prev hash")
+			}
+		} else if b.PrevHash != chain[i-1].Hash {
+			return i, errors.New("prev hash does not match the previous block")
+		}
+		if i > 0 {
+			ts, err := time.Parse(time.RFC3339, b.Timestamp)
+			if err != nil {
+				return i, errors.New("timestamp is not RFC3339")
+			}
+			if prev, err := time.Parse(time.RFC3339, chain[i-1].Timestamp); err == nil && ts.Before(prev) {
+				return i, errors.New("timestamp precedes the previous block")
+			}
+		}
+		if b.MerkleRoot != MerkleRoot(b.Transactions) {
+			return i, errors.New("merkle root does not match transactions")
+		}
+		if i > 0 {
+			if _, err := checkCoinbase(b); err != nil {
+				return i, err
+			}
+		}
+		if b.Hash != calculateHash(b) {
+			return i, errors.New("hash does not match block contents")
+		}
+		for j, t := range b.Transactions {
+			if err := validateTransaction(t); err != nil {
+				return i, fmt.Errorf("transaction %d: %w", j, err)
+			}
+		}
+		if id, dup := duplicateTransaction(b.Transactions, seen); dup {
+			return i, fmt.Errorf("duplicate transaction %q", id)
+		}
+		for _, t := range b.Transactions {
+			seen[t.ID] = i
+		}
+		if err := checkNonces(b.Transactions, nonces); err != nil {
+			return i, err
+		}
+		if i > 0 {
+			if want := nextDifficulty(chain[:i]); b.Difficulty != want {
+				return i, fmt.Errorf("difficulty %d, want %d", b.Difficulty, want)
+			}
+			if !hasProofOfWork(b.Hash, b.Difficulty) {
+				return i, errors.New("hash does not meet the proof-of-work difficulty")
+			}
+		}
+	}
+	return -1, nil
+}
+
+func (v *ValidatorNode) IsActive() bool {
+	if v == nil {
+		return false
+	}
+	v.keyMu.RLock()
+	defer v.keyMu.RUnlock()
+	return v.active
+}
+
+// SetActive moves the validator in or out of the active signing set
+func (v *ValidatorNode) SetActive(active bool) {
+	v.keyMu.Lock()
+	defer v.keyMu.Unlock()
+	if v.active && !active {
+		v.deactivatedAt = time.Now()
+	} else if active {
+		v.deactivatedAt = time.Time{}
+	}
+	v.active = active
+}
+
+// activeAt reports whether the validator was in the signing set at t. The caller must hold keyMu.
+func (v *ValidatorNode) activeAt(t time.Time) bool {
+	return v.active || (!v.deactivatedAt.IsZero() && t.Before(v.deactivatedAt))
+}
+
+// RotateKey replaces the validator's current key, moving the old one into the history
+func (v *ValidatorNode) RotateKey(newKey string) {
+	v.keyMu.Lock()
+	defer v.keyMu.Unlock()
+
+	v.KeyHistory = append(v.KeyHistory, RetiredKey{PublicKey: v.PublicKey, RetiredAt: time.Now()})
+	if len(v.KeyHistory) > MaxKeyHistory {
+		v.KeyHistory = v.KeyHistory[len(v.KeyHistory)-MaxKeyHistory:]
+	}
+	v.PublicKey = newKey
+}
+
+// SignBlock produces the validator signature for a block: a base64 Ed25519 signature of the block hash
+func SignBlock(b Block, key ed25519.PrivateKey) string {
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(key, []byte(b.Hash)))
+}
+
+// verifySignature checks a base64 signature over the block hash against a base64 Ed25519 public key
+func verifySignature(b Block, signature, publicKey string) bool {
+	pub, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return false
+	}
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return false
+	}
+	return ed25519.Verify(ed25519.PublicKey(pub), []byte(b.Hash), sig)
+}
+
+// signatureValid checks the block signature against the current key, or a retired
+// key if the block was signed before that key was rotated out and the grace window is still open.
+func (v *ValidatorNode) signatureValid(b Block) bool {
+	v.keyMu.RLock()
+	defer v.keyMu.RUnlock()
+
+	for _, vs := range b.ValidatorSigs {
+		if vs.Validator == v.Name && v.keySigned(b, vs.Sig, false) {
+			return true
+		}
+	}
+	return false
+}
+
+// keySigned checks one signature against the validator's keys. The caller must hold keyMu.
+// Proposals only accept a retired key within KeyGraceWindow of its rotation; historical
+// blocks, already part of some chain, are checked against every key in the history.
+func (v *ValidatorNode) keySigned(b Block, sig string, historical bool) bool {
+	if verifySignature(b, sig, v.PublicKey) {
+		return true
+	}
+
+	// New signatures must use the current key, so retired keys only cover blocks
+	// whose timestamp shows they were produced before the rotation.
+	signedAt, err := time.Parse(time.RFC3339, b.Timestamp)
+	if err != nil {
+		return false
+	}
+	for _, old := range v.KeyHistory {
+		if signedAt.After(old.RetiredAt) || (!historical && time.Since(old.RetiredAt) > KeyGraceWindow) {
+			continue
+		}
+		if verifySignature(b, sig, old.PublicKey) {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateBlock implements the interface. A nil validator has no key to check
+// the signature against, so it fails closed.
+func (v *ValidatorNode) ValidateBlock(b Block) bool {
+	if v == nil {
+		return false
+	}
+
+	if b.MerkleRoot != MerkleRoot(b.Transactions) {
+		return false
+	}
+	if b.Difficulty < MinDifficulty || b.Hash != calculateHash(b) || !hasProofOfWork(b.Hash, b.Difficulty) {
+		return false
+	}
+	return v.signatureValid(b)
+}
+
+// --- VALIDATOR REGISTRY ---
+
+// Quorum is how many distinct active, registered validators must sign a block
+var Quorum = 1
+
+// quorumSigners counts the distinct active, registered validators with a valid
+// signature on b. Repeated signatures from one validator count once. A historical
+// block is judged as of its timestamp: validators deactivated since then still
+// count, and retired keys verify regardless of KeyGraceWindow.
+func quorumSigners(b Block, historical bool) int {
+	validatorsMu.RLock()
+	defer validatorsMu.RUnlock()
+
+	signedAt, err := time.Parse(time.RFC3339, b.Timestamp)
+	if err != nil {
+		historical = false
+	}
+	counted := make(map[string]bool)
+	for _, vs := range b.ValidatorSigs {
+		v, ok := validators[vs.Validator]
+		if !ok || counted[v.Name] {
+			continue
+		}
+		v.keyMu.RLock()
+		active := v.active
+		if historical {
+			active = v.activeAt(signedAt)
+		}
+		valid := active && v.keySigned(b, vs.Sig, historical)
+		v.keyMu.RUnlock()
+		if valid {
+			counted[v.Name] = true
+		}
+	}
+	return len(counted)
+}
+
+// trustedNode is the validator every node starts with.
+// Its public key can be overridden with CHAIN_TRUSTED_PUBKEY.
+var trustedNode = &ValidatorNode{Name: "trusted_node", PublicKey: "AgQo2c80nt9d6AOpNBFbTiPA4U+yAEuRKSDwzL81RiY=", active: true}
+
+var (
+	validators   = map[string]*ValidatorNode{trustedNode.Name: trustedNode}
+	validatorsMu sync.RWMutex
+)
+
+// RegisterValidator adds v to the registry, replacing any validator with the same name
+func RegisterValidator(v *ValidatorNode) {
+	validatorsMu.Lock()
+	defer validatorsMu.Unlock()
+	validators[v.Name] = v
+}
+
+// RemoveValidator drops a validator from the registry
+func RemoveValidator(name string) {
+	validatorsMu.Lock()
+	defer validatorsMu.Unlock()
+	delete(validators, name)
+}
+
+// LookupValidator returns the registered validator with the given name
+func LookupValidator(name string) (*ValidatorNode, error) {
+	validatorsMu.RLock()
+	defer validatorsMu.RUnlock()
+	if v, ok := validators[name]; ok {
+		return v, nil
+	}
+	return nil, errors.New("validator not found")
+}
+
+// --- LOGGING ---
+
+// logger writes one JSON object per event
+var logger = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+// ctxKey is the context key for the *requestInfo LoggingMiddleware attaches
+type ctxKey struct{}
+
+// requestInfo is what a request's log line collects while the request is served
+type requestInfo struct {
+	id          string
+	accessLevel string // Set by authenticate; empty if no key was checked
+}
+
+// requestLogger returns logger tagged with the request ID in ctx, if any
+func requestLogger(ctx context.Context) *slog.Logger {
+	if info, ok := ctx.Value(ctxKey{}).(*requestInfo); ok {
+		return logger.With("request_id", info.id)
+	}
+	return logger
+}
+
+// statusRecorder captures the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.status = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// Hijack lets WebSocket upgrades through the recorder
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+	return hj.Hijack()
+}
+
+// LoggingMiddleware tags each request with an ID (X-Request-ID, or a generated one)
+// and logs it once it completes
+func LoggingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := r.Header.Get("X-Request-ID")
+		if id == "" {
+			var buf [8]byte
+			rand.Read(buf[:])
+			id = hex.EncodeToString(buf[:])
+		}
+		w.Header().Set("X-Request-ID", id)
+		info := &requestInfo{id: id}
+		r = r.WithContext(context.WithValue(r.Context(), ctxKey{}, info))
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		accessLevel := info.accessLevel
+		if accessLevel == "" {
+			accessLevel = "none"
+		}
+		requestLogger(r.Context()).Info("request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.status,
+			"latency_ms", time.Since(start).Milliseconds(),
+			"validator_id", r.Header.Get("X-Validator-ID"),
+			"access_level", accessLevel,
+		)
+	})
+}
+
+// --- METRICS ---
+
+var (
+	blocksTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gochain_blocks_total",
+		Help: "Block proposals by result (accepted, rejected) and rejection reason.",
+	}, []string{"result", "reason"})
+
+	proposalDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "gochain_proposal_duration_seconds",
+		Help:    "Latency of block proposal handling, from validation through commit.",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	chainHeight = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "gochain_chain_height",
+		Help: "Index of the chain tip.",
+	}, func() float64 {
+		mutex.RLock()
+		defer mutex.RUnlock()
+		return float64(len(blockchain) - 1)
+	})
+
+	mempoolSize = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "gochain_mempool_size",
+		Help: "Transactions waiting in the mempool.",
+	}, func() float64 {
+		mempoolMu.Lock()
+		defer mempoolMu.Unlock()
+		return float64(len(mempool))
+	})
+)
+
+func init() {
+	prometheus.MustRegister(blocksTotal, proposalDuration, chainHeight, mempoolSize)
+}
+
+// recordProposal counts one proposal outcome; an empty reason means it was accepted
+func recordProposal(reason string) {
+	if reason == "" {
+		blocksTotal.WithLabelValues("accepted", "").Inc()
+		return
+	}
+	blocksTotal.WithLabelValues("rejected", reason).Inc()
+}
+
+// --- RATE LIMITING ---
+
+// RateLimiter is a set of per-IP token buckets refilling at Rate tokens per
+// second up to Burst. Set Rate and Burst before serving.
+type RateLimiter struct {
+	Rate  float64
+	Burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// maxRateBuckets is how many buckets a RateLimiter keeps before evicting idle ones
+const maxRateBuckets = 10000
+
+var (
+	// ProposeLimiter throttles block proposals over HTTP and gRPC
+	ProposeLimiter = &RateLimiter{Rate: 1, Burst: 5}
+	// TxLimiter throttles transaction submissions
+	TxLimiter = &RateLimiter{Rate: 10, Burst: 20}
+)
+
+// take spends a token from ip's bucket. When the bucket is empty it returns
+// false and how long until the next token is available.
+func (l *RateLimiter) take(ip string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// A bucket idle long enough to refill is the same as a new one, so drop
+	// those once the map grows instead of keeping every IP ever seen.
+	if len(l.buckets) > maxRateBuckets {
+		full := time.Duration(l.Burst / l.Rate * float64(time.Second))
+		for k, b := range l.buckets {
+			if now.Sub(b.last) > full {
+				delete(l.buckets, k)
+			}
+		}
+	}
+
+	if l.buckets == nil {
+		l.buckets = make(map[string]*tokenBucket)
+	}
+	b, ok := l.buckets[ip]
+	if !ok {
+		b = &tokenBucket{tokens: l.Burst, last: now}
+		l.buckets[ip] = b
+	}
+	b.tokens = math.Min(l.Burst, b.tokens+now.Sub(b.last).Seconds()*l.Rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.Rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// RateLimitMiddleware throttles each client IP with a token bucket from limiter
+func RateLimitMiddleware(limiter *RateLimiter, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ip, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			ip = r.RemoteAddr
+		}
+		if ok, wait := limiter.take(ip, time.Now()); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// --- HANDLERS ---
+
+// decodeBody decodes a JSON body of at most maxBytes into v, writing a 413 or 400
+// and returning false if it cannot
+func decodeBody(w http.ResponseWriter, r *http.Request, v interface{}, maxBytes int64) bool {
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBytes)).Decode(v); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return false
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func HandleProposeBlock(w http.ResponseWriter, r *http.Request) {
+	var newBlock Block
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, MaxBlockBytes)).Decode(&newBlock); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			recordProposal("too_large")
+			http.Error(w, "Block too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		recordProposal("malformed")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := proposeBlock(r.Context(), r.Header.Get("X-API-Key"), r.Header.Get("X-Validator-ID"), newBlock); err != nil {
+		http.Error(w, err.Message, err.Status)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintln(w, "Block accepted")
+}
+
+// proposalError is a rejected block proposal. Status is the HTTP status code;
+// other transports map it onto their own codes. Reason is the metrics label.
+type proposalError struct {
+	Status  int
+	Reason  string
+	Message string
+}
+
+func (e *proposalError) Error() string { return e.Message }
+
+func rejectProposal(status int, reason, msg string) *proposalError {
+	return &proposalError{Status: status, Reason: reason, Message: msg}
+}
+
+// proposeBlock runs access control and validation for a proposed block and commits
+// it to the chain. It is shared by every transport so they enforce the same rules.
+func proposeBlock(ctx context.Context, apiKey, validatorName string, newBlock Block) (perr *proposalError) {
+	defer func(start time.Time) {
+		proposalDuration.Observe(time.Since(start).Seconds())
+		if perr != nil {
+			recordProposal(perr.Reason)
+		} else {
+			recordProposal("")
+		}
+	}(time.Now())
+
+	if len(newBlock.Transactions) > MaxBlockTxCount {
+		return rejectProposal(http.StatusRequestEntityTooLarge, "too_large", fmt.Sprintf("Block has more than %d transactions", MaxBlockTxCount))
+	}
+	// Every block carries a coinbase, so "empty" means nothing besides it
+	if len(newBlock.Transactions) <= 1 && !AllowEmptyBlocks {
+		return rejectProposal(http.StatusBadRequest, "empty_block", "Empty blocks are not accepted")
+	}
+
+	// 1. ACCESS CONTROL
+	// Only Admin (0) can propose blocks; an unknown key is refused like a Guest
+	level, err := authenticate(ctx, apiKey)
+	if err != nil {
+		logAuthRejected(ctx, "propose blocks", apiKey, err)
+		return rejectProposal(http.StatusForbidden, "unauthorized", "Invalid API key")
+	}
+	if level != AccessAdmin {
+		logAuthRejected(ctx, "propose blocks", apiKey, nil)
+		return rejectProposal(http.StatusForbidden, "unauthorized", "Unauthorized: Only Admins can propose blocks")
+	}
+
+	// 2. VALIDATION
+	if newBlock.Index == 0 {
+		return rejectProposal(http.StatusBadRequest, "invalid", "Genesis block cannot be proposed")
+	}
+	if err := validateBlockFields(newBlock); err != nil {
+		return rejectProposal(http.StatusBadRequest, "malformed", "Invalid block: "+err.Error())
+	}
+
+	for i, t := range newBlock.Transactions {
+		if err := validateTransaction(t); err != nil {
+			return rejectProposal(http.StatusBadRequest, "bad_tx", fmt.Sprintf("Transaction %d: %v", i, err))
+		}
+	}
+
+	blockTime, err := time.Parse(time.RFC3339, newBlock.Timestamp)
+	if err != nil {
+		return rejectProposal(http.StatusBadRequest, "invalid", "Timestamp must be RFC3339")
+	}
+	if blockTime.After(time.Now().Add(MaxClockSkew)) {
+		return rejectProposal(http.StatusBadRequest, "invalid", "Timestamp is too far in the future")
+	}
+
+	if newBlock.MerkleRoot != MerkleRoot(newBlock.Transactions) {
+		return rejectProposal(http.StatusBadRequest, "bad_merkle", "Merkle root does not match transactions")
+	}
+
+	credited, err := checkCoinbase(newBlock)
+	if err != nil {
+		return rejectProposal(http.StatusBadRequest, "bad_coinbase", "Invalid coinbase: "+err.Error())
+	}
+	if credited != validatorName {
+		return rejectProposal(http.StatusBadRequest, "bad_coinbase", "Invalid coinbase: must credit the proposing validator")
+	}
+
+	// Every block must be signed by a known validator. An unknown validator is
+	// rejected here rather than wrapped in the interface as a typed nil.
+	valPtr, err := LookupValidator(validatorName)
+	if err != nil {
+		return rejectProposal(http.StatusForbidden, "unauthorized", "Unknown validator")
+	}
+
+	var validator ValidatorInterface = valPtr
+	if !validator.IsActive() {
+		return rejectProposal(http.StatusForbidden, "unauthorized", "validator inactive")
+	}
+	if !validator.ValidateBlock(newBlock) {
+		return rejectProposal(http.StatusBadRequest, "bad_sig", "Block validation failed")
+	}
+	if quorumSigners(newBlock, false) < Quorum {
+		return rejectProposal(http.StatusForbidden, "bad_sig", fmt.Sprintf("Block needs signatures from %d active validators", Quorum))
+	}
+
+	// 3. COMMIT
+	return commitBlock(newBlock, blockTime)
+}
+
+// commitBlock appends a validated block to the chain. Linkage is checked under the
+// same lock as the append so two proposals for the same height cannot both be accepted.
+func commitBlock(newBlock Block, blockTime time.Time) *proposalError {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	last := blockchain[len(blockchain)-1]
+	if newBlock.Index != len(blockchain) || newBlock.PrevHash != last.Hash {
+		return rejectProposal(http.StatusConflict, "bad_link", "block does not extend chain")
+	}
+	if prevTime, err := time.Parse(time.RFC3339, last.Timestamp); err == nil && blockTime.Before(prevTime) {
+		return rejectProposal(http.StatusBadRequest, "invalid", "Timestamp precedes the previous block")
+	}
+	if want := nextDifficulty(blockchain); newBlock.Difficulty != want {
+		return rejectProposal(http.StatusBadRequest, "bad_difficulty", fmt.Sprintf("Block difficulty must be %d", want))
+	}
+	if _, dup := duplicateTransaction(newBlock.Transactions, txIndex); dup {
+		return rejectProposal(http.StatusConflict, "duplicate", "duplicate transaction")
+	}
+	nonces := make(map[string]int)
+	for _, t := range newBlock.Transactions {
+		nonces[t.PubKey] = senderNonces[t.PubKey]
+	}
+	if err := checkNonces(newBlock.Transactions, nonces); err != nil {
+		return rejectProposal(http.StatusConflict, "bad_nonce", err.Error())
+	}
+
+	blockchain = append(blockchain, newBlock)
+	if err := saveChain(chainPath); err != nil {
+		blockchain = blockchain[:len(blockchain)-1]
+		log.Printf("Persist error: %v", err)
+		return rejectProposal(http.StatusInternalServerError, "persist_error", "Failed to persist block")
+	}
+	for _, t := range newBlock.Transactions {
+		txIndex[t.ID] = newBlock.Index
+	}
+	for sender, nonce := range nonces {
+		senderNonces[sender] = nonce
+	}
+	pruneMempool()
+	// Broadcasting under the lock keeps notifications in chain order and lines
+	// up with the tip HandleSubscribe sends on connect.
+	broadcastBlock(newBlock)
+	return nil
+}
+
+// HandleSubmitTx adds a transaction to the mempool
+func HandleSubmitTx(w http.ResponseWriter, r *http.Request) {
+	var tx Transaction
+	if !decodeBody(w, r, &tx, MaxTxBytes) {
+		return
+	}
+	if err := validateTransaction(tx); err != nil {
+		http.Error(w, "Transaction: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if tx.Coinbase {
+		http.Error(w, "Coinbase transactions are created by validators", http.StatusBadRequest)
+		return
+	}
+
+	mutex.RLock()
+	_, duplicate := txIndex[tx.ID]
+	lastNonce := senderNonces[tx.PubKey]
+	mutex.RUnlock()
+	if tx.Nonce <= lastNonce {
+		http.Error(w, fmt.Sprintf("nonce must be greater than %d", lastNonce), http.StatusConflict)
+		return
+	}
+
+	mempoolMu.Lock()
+	for _, pending := range mempool {
+		if pending.ID == tx.ID {
+			duplicate = true
+			break
+		}
+	}
+	if duplicate {
+		mempoolMu.Unlock()
+		http.Error(w, "duplicate transaction", http.StatusConflict)
+		return
+	}
+	if len(mempool) >= MaxMempoolSize {
+		mempoolMu.Unlock()
+		w.Header().Set("Retry-After", strconv.Itoa(int(TargetBlockTime.Seconds())))
+		http.Error(w, "mempool full", http.StatusServiceUnavailable)
+		return
+	}
+	mempool = append(mempool, tx)
+	mempoolMu.Unlock()
+
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintln(w, "Transaction queued")
+}
+
+// HandleGetTx reports where a transaction landed. Transactions still waiting in the
+// mempool get a 404 with status "pending" since they are not in any block yet.
+func HandleGetTx(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	mutex.RLock()
+	if index, ok := txIndex[id]; ok {
+		block := blockchain[index]
+		mutex.RUnlock()
+		for _, t := range block.Transactions {
+			if t.ID == id {
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"status":      "confirmed",
+					"block_index": block.Index,
+					"block_hash":  block.Hash,
+					"transaction": t,
+				})
+				return
+			}
+		}
+	} else {
+		mutex.RUnlock()
+	}
+
+	mempoolMu.Lock()
+	var pending *Transaction
+	for i := range mempool {
+		if mempool[i].ID == id {
+			t := mempool[i]
+			pending = &t
+			break
+		}
+	}
+	mempoolMu.Unlock()
+
+	if pending == nil {
+		http.Error(w, "Transaction not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusNotFound)
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "pending", "transaction": pending})
+}
+
+// HandleBlockTemplate returns the next candidate block for ?validator= to mine, sign and propose
+func HandleBlockTemplate(w http.ResponseWriter, r *http.Request) {
+	validator := r.URL.Query().Get("validator")
+	if _, err := LookupValidator(validator); err != nil {
+		http.Error(w, "Unknown validator", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(assembleBlock(validator))
+}
+
+// HandleGetChain returns the chain, optionally limited to the inclusive index range ?from=&to=
+func HandleGetChain(w http.ResponseWriter, r *http.Request) {
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	from, to := 0, len(blockchain)-1
+	if v := r.URL.Query().Get("from"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "Invalid from index", http.StatusBadRequest)
+			return
+		}
+		from = n
+	}
+	if v := r.URL.Query().Get("to"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "Invalid to index", http.StatusBadRequest)
+			return
+		}
+		if n < to {
+			to = n
+		}
+	}
+
+	blocks := []Block{}
+	if from <= to {
+		blocks = blockchain[from : to+1]
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(blocks)
+}
+
+// HandleGetBlock returns a single block by ?index=N or ?hash=...
+func HandleGetBlock(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	var block *Block
+	switch {
+	case q.Get("index") != "":
+		n, err := strconv.Atoi(q.Get("index"))
+		if err != nil {
+			http.Error(w, "Invalid index", http.StatusBadRequest)
+			return
+		}
+		if n >= 0 && n < len(blockchain) {
+			block = &blockchain[n]
+		}
+	case q.Get("hash") != "":
+		for i := range blockchain {
+			if blockchain[i].Hash == q.Get("hash") {
+				block = &blockchain[i]
+				break
+			}
+		}
+	default:
+		http.Error(w, "index or hash is required", http.StatusBadRequest)
+		return
+	}
+
+	if block == nil {
+		http.Error(w, "Block not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(block)
+}
+
+// HandleReplaceChain adopts a candidate chain under the longest-chain rule. Admin only.
+func HandleReplaceChain(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r, "replace the chain") {
+		return
+	}
+
+	var candidate []Block
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, MaxChainBytes)).Decode(&candidate); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "Chain too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	height, err := replaceChain(candidate)
+	if errors.Is(err, errChainNotLonger) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if errors.Is(err, errPersistChain) {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Invalid chain: "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	log.Printf("Adopted replacement chain at height %d", height)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"height": height})
+}
+
+// HandleRollbackBlock drops the tip block during incident response and returns its
+// transactions to the mempool. The genesis block cannot be removed. Admin only.
+func HandleRollbackBlock(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r, "roll back blocks") {
+		return
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if len(blockchain) == 1 {
+		http.Error(w, "Cannot roll back the genesis block", http.StatusConflict)
+		return
+	}
+	removed := blockchain[len(blockchain)-1]
+	blockchain = blockchain[:len(blockchain)-1]
+	if err := saveChain(chainPath); err != nil {
+		blockchain = append(blockchain, removed)
+		log.Printf("Persist error: %v", err)
+		http.Error(w, "Failed to persist chain", http.StatusInternalServerError)
+		return
+	}
+	reindexChain()
+
+	var restored []Transaction
+	for _, t := range removed.Transactions {
+		if !t.Coinbase {
+			restored = append(restored, t)
+		}
+	}
+	mempoolMu.Lock()
+	mempool = append(restored, mempool...)
+	mempoolMu.Unlock()
+	log.Printf("Rolled back block %d (%s)", removed.Index, removed.Hash)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"rolled_back": removed.Index,
+		"tip":         blockchain[len(blockchain)-1],
+	})
+}
+
+// HandleExportChain streams the chain as ?format=json (default) or ?format=gob
+func HandleExportChain(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "gob" {
+		http.Error(w, "format must be json or gob", http.StatusBadRequest)
+		return
+	}
+
+	// Copy the block headers so the lock is not held while a slow client reads
+	mutex.RLock()
+	chain := append([]Block(nil), blockchain...)
+	mutex.RUnlock()
+
+	if format == "gob" {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		for _, b := range chain {
+			if err := writeGobBlock(w, b); err != nil {
+				return
+			}
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	io.WriteString(w, "[\n")
+	for i, b := range chain {
+		data, _ := json.MarshalIndent(b, "  ", "  ")
+		io.WriteString(w, "  ")
+		w.Write(data)
+		if i < len(chain)-1 {
+			io.WriteString(w, ",")
+		}
+		io.WriteString(w, "\n")
+	}
+	io.WriteString(w, "]\n")
+}
+
+// HandleImportChain validates and loads an exported chain. Unlike /chain/replace it
+// may restore a shorter chain, e.g. a backup after a bad fork. Admin only.
+func HandleImportChain(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r, "import the chain") {
+		return
+	}
+
+	body := http.MaxBytesReader(w, r.Body, MaxChainBytes)
+	var chain []Block
+	var err error
+	switch r.URL.Query().Get("format") {
+	case "", "json":
+		chain, err = readJSONChain(body)
+	case "gob":
+		for {
+			var b Block
+			b, err = readGobBlock(body)
+			if err != nil {
+				break
+			}
+			chain = append(chain, b)
+		}
+		if errors.Is(err, io.EOF) {
+			err = nil
+		}
+	default:
+		http.Error(w, "format must be json or gob", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "Chain too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "Invalid chain data: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	height, err := adoptChain(chain, false)
+	if errors.Is(err, errPersistChain) {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Invalid chain: "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	log.Printf("Imported chain at height %d", height)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"height": height})
+}
+
+// HandleAddPeer registers a peer for chain sync. Admin only.
+func HandleAddPeer(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r, "register peers") {
+		return
+	}
+
+	var req struct {
+		URL string `json:"url"`
+	}
+	if !decodeBody(w, r, &req, MaxRequestBytes) {
+		return
+	}
+	if err := AddPeer(req.URL); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintln(w, "Peer registered")
+}
+
+// HandleStatus reports the chain tip and node counters for monitoring
+func HandleStatus(w http.ResponseWriter, r *http.Request) {
+	mutex.RLock()
+	height := len(blockchain)
+	tipHash := blockchain[height-1].Hash
+	mutex.RUnlock()
+
+	mempoolMu.Lock()
+	mempoolSize := len(mempool)
+	mempoolMu.Unlock()
+
+	validatorsMu.RLock()
+	validatorCount := len(validators)
+	validatorsMu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"height":       height,
+		"tip_hash":     tipHash,
+		"mempool_size": mempoolSize,
+		"validators":   validatorCount,
+	})
+}
+
+// HandleValidateChain reports whether the stored chain is self-consistent
+func HandleValidateChain(w http.ResponseWriter, r *http.Request) {
+	mutex.RLock()
+	index, err := validateChain(blockchain)
+	mutex.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(map[string]interface{}{"valid": false, "index": index, "reason": err.Error()})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"valid": true})
+}
+
+// HandleRegisterValidator adds or replaces a validator in the registry. Admin only.
+func HandleRegisterValidator(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r, "register validators") {
+		return
+	}
+
+	var req struct {
+		Name      string `json:"name"`
+		PublicKey string `json:"public_key"`
+		Active    *bool  `json:"active"` // defaults to true
+	}
+	if !decodeBody(w, r, &req, MaxRequestBytes) {
+		return
+	}
+	if req.Name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+	if pub, err := base64.StdEncoding.DecodeString(req.PublicKey); err != nil || len(pub) != ed25519.PublicKeySize {
+		http.Error(w, "public_key must be a base64 Ed25519 public key", http.StatusBadRequest)
+		return
+	}
+
+	active := req.Active == nil || *req.Active
+	RegisterValidator(&ValidatorNode{Name: req.Name, PublicKey: req.PublicKey, active: active})
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintln(w, "Validator registered")
+}
+
+// --- AUTH ---
+
+// Access levels. Lower is more privileged.
+const (
+	AccessAdmin = 0
+	AccessGuest = 1
+)
+
+var errUnknownAPIKey = errors.New("unknown API key")
+
+// apiCredentials maps API keys to access levels
+var (
+	apiCredentials = map[string]int{
+		"secret_admin": AccessAdmin,
+	}
+	apiCredentialsMu sync.RWMutex
+)
+
+// checkApiKey looks a key up in the credentials store. Callers without a key are
+// Guests; a key that is not in the store is an error, never a downgrade.
+func checkApiKey(key string) (int, error) {
+	if key == "" {
+		return AccessGuest, nil
+	}
+	apiCredentialsMu.RLock()
+	defer apiCredentialsMu.RUnlock()
+	level, ok := apiCredentials[key]
+	if !ok {
+		return 0, errUnknownAPIKey
+	}
+	return level, nil
+}
+
+// authenticate is checkApiKey for a request being served: it also records the
+// resulting access level for the request's log line
+func authenticate(ctx context.Context, key string) (int, error) {
+	level, err := checkApiKey(key)
+	if info, ok := ctx.Value(ctxKey{}).(*requestInfo); ok {
+		info.accessLevel = "invalid"
+		if err == nil {
+			info.accessLevel = strconv.Itoa(level)
+		}
+	}
+	return level, err
+}
+
+// requireAdmin rejects callers that are not Admins, whether their key is unknown or
+// only grants Guest access. It writes the response and returns false when the request
+// must stop.
+func requireAdmin(w http.ResponseWriter, r *http.Request, action string) bool {
+	apiKey := r.Header.Get("X-API-Key")
+	level, err := authenticate(r.Context(), apiKey)
+	if err != nil {
+		logAuthRejected(r.Context(), action, apiKey, err)
+		http.Error(w, "Invalid API key", http.StatusForbidden)
+		return false
+	}
+	if level != AccessAdmin {
+		logAuthRejected(r.Context(), action, apiKey, nil)
+		http.Error(w, "Unauthorized: Only Admins can "+action, http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// logAuthRejected records a refused admin action. A caller without a key was
+// treated as a Guest; a caller with an unknown key is rejected outright.
+func logAuthRejected(ctx context.Context, action, apiKey string, err error) {
+	attrs := []any{"action", action, "guest", apiKey == ""}
+	if err != nil {
+		attrs = append(attrs, "error", err.Error())
+	}
+	requestLogger(ctx).Warn("auth rejected", attrs...)
+}
+
+// --- BLOCK SUBSCRIPTIONS ---
+
+const (
+	// subscriberBuffer is how many blocks may queue for a client before it is dropped as too slow
+	subscriberBuffer = 16
+	// subscriberWriteTimeout bounds a single write to a subscriber
+	subscriberWriteTimeout = 10 * time.Second
+)
+
+type subscriber struct {
+	blocks chan Block
+}
+
+var (
+	subscribers   = map[*subscriber]bool{}
+	subscribersMu sync.Mutex
+	upgrader      = websocket.Upgrader{ReadBufferSize: 1024, WriteBufferSize: 1024}
+)
+
+// broadcastBlock queues b for every subscriber. A subscriber whose queue is full
+// is dropped rather than allowed to hold up block commits.
+func broadcastBlock(b Block) {
+	subscribersMu.Lock()
+	defer subscribersMu.Unlock()
+	for sub := range subscribers {
+		select {
+		case sub.blocks <- b:
+		default:
+			delete(subscribers, sub)
+			close(sub.blocks)
+		}
+	}
+}
+
+// closeSubscribers ends every subscription. WebSocket connections are hijacked,
+// so http.Server.Shutdown does not close them itself.
+func closeSubscribers() {
+	subscribersMu.Lock()
+	defer subscribersMu.Unlock()
+	for sub := range subscribers {
+		delete(subscribers, sub)
+		close(sub.blocks)
+	}
+}
+
+func unsubscribe(sub *subscriber) {
+	subscribersMu.Lock()
+	defer subscribersMu.Unlock()
+	if subscribers[sub] {
+		delete(subscribers, sub)
+		close(sub.blocks)
+	}
+}
+
+// HandleSubscribe streams newly committed blocks over a WebSocket, starting with the current tip
+func HandleSubscribe(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return // Upgrade has already written the error response
+	}
+	defer conn.Close()
+
+	sub := &subscriber{blocks: make(chan Block, subscriberBuffer)}
+	mutex.RLock()
+	sub.blocks <- blockchain[len(blockchain)-1]
+	subscribersMu.Lock()
+	subscribers[sub] = true
+	subscribersMu.Unlock()
+	mutex.RUnlock()
+
+	// Clients only listen; reading surfaces their disconnect.
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				unsubscribe(sub)
+				return
+			}
+		}
+	}()
+
+	for b := range sub.blocks {
+		conn.SetWriteDeadline(time.Now().Add(subscriberWriteTimeout))
+		if err := conn.WriteJSON(b); err != nil {
+			unsubscribe(sub)
+			return
+		}
+	}
+}
+
+// --- GRPC ---
+// Implements the Chain service in chain.proto. Messages are exchanged as JSON
+// (content-subtype "json"), so the Go types below double as the wire schema.
+
+// GRPCAddr is where the gRPC server listens
+var GRPCAddr = ":9081"
+
+type BlockRequest struct {
+	Block Block `json:"block"`
+}
+
+type BlockResponse struct {
+	Status string `json:"status"`
+	Index  int    `json:"index"`
+	Hash   string `json:"hash"`
+}
+
+// ChainServer is the server API for the Chain service
+type ChainServer interface {
+	ProposeBlock(ctx context.Context, req *BlockRequest) (*BlockResponse, error)
+}
+
+// jsonCodec marshals gRPC messages with encoding/json
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+func (jsonCodec) Name() string                               { return "json" }
+
+var chainServiceDesc = grpc.ServiceDesc{
+	ServiceName: "gochain.Chain",
+	HandlerType: (*ChainServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{MethodName: "ProposeBlock", Handler: chainProposeBlockHandler},
+	},
+	Metadata: "chain.proto",
+}
+
+func chainProposeBlockHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BlockRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ChainServer).ProposeBlock(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/gochain.Chain/ProposeBlock"}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ChainServer).ProposeBlock(ctx, req.(*BlockRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+type chainServer struct{}
+
+func (chainServer) ProposeBlock(ctx context.Context, req *BlockRequest) (*BlockResponse, error) {
+	if p, ok := peer.FromContext(ctx); ok {
+		ip, _, err := net.SplitHostPort(p.Addr.String())
+		if err != nil {
+			ip = p.Addr.String()
+		}
+		if ok, _ := ProposeLimiter.take(ip, time.Now()); !ok {
+			return nil, status.Error(codes.ResourceExhausted, "Too many proposals")
+		}
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	if err := proposeBlock(ctx, firstMetadata(md, "x-api-key"), firstMetadata(md, "x-validator-id"), req.Block); err != nil {
+		return nil, status.Error(grpcCode(err.Status), err.Message)
+	}
+	return &BlockResponse{Status: "accepted", Index: req.Block.Index, Hash: req.Block.Hash}, nil
+}
+
+func firstMetadata(md metadata.MD, key string) string {
+	if values := md.Get(key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// grpcCode maps a proposal rejection's HTTP status onto a gRPC status code
+func grpcCode(httpStatus int) codes.Code {
+	switch httpStatus {
+	case http.StatusBadRequest:
+		return codes.InvalidArgument
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusConflict:
+		return codes.FailedPrecondition
+	case http.StatusRequestEntityTooLarge, http.StatusTooManyRequests:
+		return codes.ResourceExhausted
+	default:
+		return codes.Internal
+	}
+}
+
+// serveGRPC starts the gRPC server on GRPCAddr
+func serveGRPC() (*grpc.Server, error) {
+	lis, err := net.Listen("tcp", GRPCAddr)
+	if err != nil {
+		return nil, err
+	}
+	encoding.RegisterCodec(jsonCodec{})
+	srv := grpc.NewServer(grpc.MaxRecvMsgSize(int(MaxBlockBytes)))
+	srv.RegisterService(&chainServiceDesc, chainServer{})
+	go func() {
+		if err := srv.Serve(lis); err != nil {
+			log.Printf("gRPC server error: %v", err)
+		}
+	}()
+	return srv, nil
+}
+
+// stopGRPC lets in-flight RPCs finish until ctx is done, then closes the
+// remaining connections, which cancels the contexts of RPCs still running
+func stopGRPC(ctx context.Context, srv *grpc.Server) {
+	done := make(chan struct{})
+	go func() {
+		srv.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Printf("gRPC shutdown: %v, closing open connections", ctx.Err())
+		srv.Stop()
+		<-done
+	}
+}
+
+// ListenAddr is where the HTTP API listens
+var ListenAddr = ":8081"
+
+// checkListenAddr rejects an address net.Listen would fail on later, so a bad
+// setting stops the node at startup instead of after the chain is loaded
+func checkListenAddr(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		return fmt.Errorf("invalid port %q", port)
+	}
+	return nil
+}
+
+func main() {
+	slog.SetDefault(logger)
+
+	if v, ok := os.LookupEnv("CHAIN_ADDR"); ok {
+		ListenAddr = v
+	}
+	if v, ok := os.LookupEnv("CHAIN_GRPC_ADDR"); ok {
+		GRPCAddr = v
+	}
+	if err := checkListenAddr(ListenAddr); err != nil {
+		log.Fatalf("CHAIN_ADDR: %v", err)
+	}
+	if err := checkListenAddr(GRPCAddr); err != nil {
+		log.Fatalf("CHAIN_GRPC_ADDR: %v", err)
+	}
+
+	if key := os.Getenv("CHAIN_TRUSTED_PUBKEY"); key != "" {
+		trustedNode.PublicKey = key
+	}
+	if path, ok := os.LookupEnv("CHAIN_DATA_PATH"); ok {
+		chainPath = path
+	}
+	if chainPath == "" {
+		initChain()
+	} else if err := loadChain(chainPath); err != nil {
+		log.Fatalf("Failed to load chain: %v", err)
+	}
+
+	for _, p := range strings.Split(os.Getenv("CHAIN_PEERS"), ",") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		if err := AddPeer(p); err != nil {
+			log.Fatalf("CHAIN_PEERS: %v", err)
+		}
+	}
+	if v := os.Getenv("CHAIN_SYNC_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			log.Fatalf("CHAIN_SYNC_INTERVAL: invalid duration %q", v)
+		}
+		SyncInterval = d
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go runPeerSync(ctx)
+
+	grpcServer, err := serveGRPC()
+	if err != nil {
+		log.Fatalf("Failed to start gRPC server: %v", err)
+	}
+	log.Printf("gRPC listening on %s", GRPCAddr)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/block/propose", RateLimitMiddleware(ProposeLimiter, HandleProposeBlock))
+	mux.HandleFunc("POST /tx", RateLimitMiddleware(TxLimiter, HandleSubmitTx))
+	mux.HandleFunc("GET /tx/{id}", HandleGetTx)
+	mux.HandleFunc("POST /validators", HandleRegisterValidator)
+	mux.HandleFunc("GET /block/template", HandleBlockTemplate)
+	mux.HandleFunc("GET /chain", HandleGetChain)
+	mux.HandleFunc("GET /block", HandleGetBlock)
+	mux.HandleFunc("GET /chain/validate", HandleValidateChain)
+	mux.HandleFunc("POST /chain/replace", HandleReplaceChain)
+	mux.HandleFunc("POST /peers", HandleAddPeer)
+	mux.HandleFunc("GET /chain/export", HandleExportChain)
+	mux.HandleFunc("POST /block/rollback", HandleRollbackBlock)
+	mux.HandleFunc("POST /chain/import", HandleImportChain)
+	mux.HandleFunc("GET /status", HandleStatus)
+	mux.HandleFunc("GET /subscribe", HandleSubscribe)
+	mux.Handle("GET /metrics", promhttp.Handler())
+
+	srv := &http.Server{
+		Addr:    ListenAddr,
+		Handler: LoggingMiddleware(mux),
+	}
+	go func() {
+		log.Printf("GoChain node listening on %s", srv.Addr)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	<-ctx.Done()
+	log.Println("Shutting down, waiting for in-flight proposals")
+
+	// Both servers stop taking new requests and let running proposals finish
+	// their commit before the chain is flushed.
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Shutdown: %v", err)
+	}
+	stopGRPC(shutdownCtx, grpcServer)
+	closeSubscribers()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if err := saveChain(chainPath); err != nil {
+		log.Printf("Flushing chain: %v", err)
+	}
+}
@@ -0,0 +1,1383 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// --- TEST HELPERS ---
+
+// testValidator is the validator newTestChain registers
+const testValidator = "test_validator"
+
+// newTestChain resets the node to a fresh in-memory chain with an empty mempool and
+// a registry holding only testValidator, and returns that validator's signing key.
+// Difficulty is lowered so mining stays fast; everything is restored on cleanup.
+func newTestChain(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+	savedPath, savedDifficulty, savedQuorum := chainPath, Difficulty, Quorum
+	validatorsMu.Lock()
+	savedValidators := validators
+	validatorsMu.Unlock()
+	t.Cleanup(func() {
+		chainPath, Difficulty, Quorum = savedPath, savedDifficulty, savedQuorum
+		validatorsMu.Lock()
+		validators = savedValidators
+		validatorsMu.Unlock()
+		mempoolMu.Lock()
+		mempool = nil
+		mempoolMu.Unlock()
+	})
+
+	chainPath, Difficulty, Quorum = "", 1, 1
+	initChain()
+	mempoolMu.Lock()
+	mempool = nil
+	mempoolMu.Unlock()
+
+	validatorsMu.Lock()
+	validators = make(map[string]*ValidatorNode)
+	validatorsMu.Unlock()
+	return addTestValidator(t, testValidator)
+}
+
+// addTestValidator registers an active validator under name with a fresh key
+func addTestValidator(t *testing.T, name string) ed25519.PrivateKey {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	RegisterValidator(&ValidatorNode{Name: name, PublicKey: base64.StdEncoding.EncodeToString(pub), active: true})
+	return priv
+}
+
+// newSender returns a fresh sender key
+func newSender(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return priv
+}
+
+// signedTx builds a transaction from sender signed with its key
+func signedTx(sender ed25519.PrivateKey, id string, nonce, fee int) Transaction {
+	tx := Transaction{
+		ID:      id,
+		Payload: "payload-" + id,
+		Fee:     fee,
+		PubKey:  base64.StdEncoding.EncodeToString(sender.Public().(ed25519.PublicKey)),
+		Nonce:   nonce,
+	}
+	tx.Sig = SignTransaction(tx, sender)
+	return tx
+}
+
+// nextBlock builds a block on the current tip holding txs behind the coinbase for
+// testValidator, then mines and signs it
+func nextBlock(t *testing.T, key ed25519.PrivateKey, txs ...Transaction) Block {
+	t.Helper()
+	mutex.RLock()
+	chain := append([]Block(nil), blockchain...)
+	mutex.RUnlock()
+	return blockOn(chain, time.Now(), key, txs...)
+}
+
+// blockOn is nextBlock for an arbitrary chain and timestamp
+func blockOn(chain []Block, ts time.Time, key ed25519.PrivateKey, txs ...Transaction) Block {
+	tip := chain[len(chain)-1]
+	all := append([]Transaction{coinbaseTransaction(testValidator, tip.Index+1, txs)}, txs...)
+	b := Block{
+		Index:        tip.Index + 1,
+		Timestamp:    ts.UTC().Format(time.RFC3339),
+		Transactions: all,
+		MerkleRoot:   MerkleRoot(all),
+		PrevHash:     tip.Hash,
+	}
+	return sealBlock(b, nextDifficulty(chain), key)
+}
+
+// sealBlock mines b at difficulty and replaces its signatures with testValidator's
+func sealBlock(b Block, difficulty int, key ed25519.PrivateKey) Block {
+	b = mineBlock(b, difficulty)
+	b.ValidatorSigs = []ValidatorSig{{Validator: testValidator, Sig: SignBlock(b, key)}}
+	return b
+}
+
+// propose submits b as the admin on behalf of testValidator
+func propose(b Block) *proposalError {
+	return proposeBlock(context.Background(), "secret_admin", testValidator, b)
+}
+
+// --- MERKLE TREE ---
+
+// merkleTxs are the fixed transactions behind the known-answer roots
+var merkleTxs = []Transaction{
+	{ID: "a", Payload: "alpha", Fee: 1},
+	{ID: "b", Payload: "beta", Fee: 2},
+	{ID: "c", Payload: "gamma", Fee: 3},
+	{ID: "d", Payload: "delta", Fee: 4},
+}
+
+func TestMerkleForgedLeafDoesNotCollide(t *testing.T) {
+	a, b := merkleLeafHash(merkleTxs[0]), merkleLeafHash(merkleTxs[1])
+	root := MerkleRoot(merkleTxs[:2])
+
+	// A single transaction carrying the two child hashes, raw or hex encoded
+	for _, id := range []string{string(a) + string(b), hex.EncodeToString(a) + hex.EncodeToString(b)} {
+		if MerkleRoot([]Transaction{{ID: id}}) == root {
+			t.Fatalf("forged leaf %q reproduces the two-leaf root", id)
+		}
+	}
+}
+
+func TestMerkleInteriorNodeIsNotALeaf(t *testing.T) {
+	ab := merkleNodeHash(merkleLeafHash(merkleTxs[0]), merkleLeafHash(merkleTxs[1]))
+	cd := merkleNodeHash(merkleLeafHash(merkleTxs[2]), merkleLeafHash(merkleTxs[3]))
+	root := MerkleRoot(merkleTxs)
+	if hex.EncodeToString(merkleNodeHash(ab, cd)) != root {
+		t.Fatal("test tree does not match MerkleRoot")
+	}
+
+	// Presenting the interior node as a transaction, with its true sibling, must not verify
+	for _, id := range []string{string(ab), hex.EncodeToString(ab)} {
+		if VerifyMerkleProof(Transaction{ID: id}, []ProofStep{{Hash: hex.EncodeToString(cd)}}, root) {
+			t.Fatalf("interior node %q verified as a leaf", id)
+		}
+	}
+}
+
+func TestMerkleRootKnownAnswers(t *testing.T) {
+	// Independently computed: leaves are SHA-256(0x00 || canonical fields) and
+	// nodes SHA-256(0x01 || left || right), with a lone last node promoted
+	want := []string{
+		"05f16ffbcdb35ea686bd2e35a44e357e463411f8044bf1356a58b4d2e051cce4",
+		"3fc96644cfc6324c54ab220ea3b366ac571efb4dcd53d8df993c105399487670",
+		"2375d23da99707e1d9b1695641ee2bb6718c199d4d90ed14ef77c745bfb949a7",
+		"0f7c0ec42aef9ec5b788de82d7d591520a856322ff1404b31b8261e6b80f6ffe",
+	}
+	for n := 1; n <= 4; n++ {
+		if got := MerkleRoot(merkleTxs[:n]); got != want[n-1] {
+			t.Errorf("%d transactions: root %s, want %s", n, got, want[n-1])
+		}
+	}
+	if MerkleRoot(nil) != "" {
+		t.Error("empty transaction list has a non-empty root")
+	}
+}
+
+func TestMerkleOddLeafNotDuplicated(t *testing.T) {
+	padded := append(append([]Transaction(nil), merkleTxs[:3]...), merkleTxs[2])
+	if MerkleRoot(merkleTxs[:3]) == MerkleRoot(padded) {
+		t.Fatal("[a, b, c] and [a, b, c, c] share a root")
+	}
+}
+
+// proofTxs returns n distinct transactions
+func proofTxs(n int) []Transaction {
+	txs := make([]Transaction, n)
+	for i := range txs {
+		txs[i] = Transaction{ID: "tx-" + strconv.Itoa(i), Payload: "p", Fee: i}
+	}
+	return txs
+}
+
+func TestMerkleProofRoundTrip(t *testing.T) {
+	for n := 1; n <= 9; n++ {
+		txs := proofTxs(n)
+		root := MerkleRoot(txs)
+		for i := range txs {
+			proof, err := MerkleProof(txs, i)
+			if err != nil {
+				t.Fatalf("n=%d i=%d: %v", n, i, err)
+			}
+			if !VerifyMerkleProof(txs[i], proof, root) {
+				t.Errorf("n=%d i=%d: valid proof rejected", n, i)
+			}
+		}
+	}
+}
+
+func TestMerkleProofIndexOutOfRange(t *testing.T) {
+	txs := proofTxs(3)
+	for _, i := range []int{-1, 3} {
+		if _, err := MerkleProof(txs, i); err == nil {
+			t.Errorf("index %d: no error", i)
+		}
+	}
+	if _, err := MerkleProof(nil, 0); err == nil {
+		t.Error("empty list: no error")
+	}
+}
+
+func TestMerkleProofTampered(t *testing.T) {
+	txs := proofTxs(5)
+	root := MerkleRoot(txs)
+	proof, _ := MerkleProof(txs, 2)
+	if !VerifyMerkleProof(txs[2], proof, root) {
+		t.Fatal("valid proof rejected")
+	}
+
+	for i := range proof {
+		flipped := append([]ProofStep(nil), proof...)
+		hash, _ := hex.DecodeString(flipped[i].Hash)
+		hash[0] ^= 1
+		flipped[i].Hash = hex.EncodeToString(hash)
+		if VerifyMerkleProof(txs[2], flipped, root) {
+			t.Errorf("step %d: proof with a changed hash verified", i)
+		}
+
+		swapped := append([]ProofStep(nil), proof...)
+		swapped[i].Left = !swapped[i].Left
+		if VerifyMerkleProof(txs[2], swapped, root) {
+			t.Errorf("step %d: proof with a flipped side verified", i)
+		}
+	}
+
+	if VerifyMerkleProof(txs[3], proof, root) {
+		t.Error("proof verified for another transaction")
+	}
+	if VerifyMerkleProof(txs[2], proof[:len(proof)-1], root) {
+		t.Error("truncated proof verified")
+	}
+	if VerifyMerkleProof(txs[2], proof, "not-hex") {
+		t.Error("proof verified against a malformed root")
+	}
+}
+
+// --- BLOCK HASH ---
+
+func TestBlockHashCoversTransactions(t *testing.T) {
+	key := newTestChain(t)
+	sender := newSender(t)
+	b := nextBlock(t, key, signedTx(sender, "a", 1, 1), signedTx(sender, "b", 2, 1))
+
+	mutated := b
+	mutated.Transactions = append([]Transaction(nil), b.Transactions...)
+	mutated.Transactions[1].Payload = "changed"
+	mutated.MerkleRoot = MerkleRoot(mutated.Transactions)
+	if calculateHash(mutated) == b.Hash {
+		t.Fatal("mutating a transaction left the block hash unchanged")
+	}
+
+	// Keeping the old root and hash instead is caught by the root check
+	mutated.MerkleRoot = b.MerkleRoot
+	v, _ := LookupValidator(testValidator)
+	if v.ValidateBlock(mutated) {
+		t.Fatal("block with a mutated transaction validated")
+	}
+}
+
+func TestValidateBlockNilValidatorFailsClosed(t *testing.T) {
+	key := newTestChain(t)
+	var v *ValidatorNode
+	if v.ValidateBlock(nextBlock(t, key)) {
+		t.Fatal("nil validator accepted a block")
+	}
+}
+
+func TestValidateBlockHash(t *testing.T) {
+	key := newTestChain(t)
+	v, _ := LookupValidator(testValidator)
+	b := nextBlock(t, key)
+	if !v.ValidateBlock(b) {
+		t.Fatal("block with a matching hash rejected")
+	}
+
+	// Re-signed so only the hash is wrong
+	b.Hash = strings.Repeat("0", len(b.Hash))
+	b.ValidatorSigs = []ValidatorSig{{Validator: testValidator, Sig: SignBlock(b, key)}}
+	if v.ValidateBlock(b) {
+		t.Fatal("block with a mismatched hash validated")
+	}
+}
+
+func TestBlockHashIndependentOfFieldOrder(t *testing.T) {
+	a := `{"index":3,"timestamp":"2024-05-01T10:00:00Z","merkle_root":"ab","prev_hash":"cd","nonce":7,"difficulty":2,"transactions":[]}`
+	b := `{"difficulty":2,"nonce":7,"prev_hash":"cd","merkle_root":"ab","timestamp":"2024-05-01T10:00:00Z","index":3,"transactions":[]}`
+	var x, y Block
+	if err := json.Unmarshal([]byte(a), &x); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(b), &y); err != nil {
+		t.Fatal(err)
+	}
+	literal := Block{Difficulty: 2, Nonce: 7, PrevHash: "cd", MerkleRoot: "ab", Timestamp: "2024-05-01T10:00:00Z", Index: 3}
+	if calculateHash(x) != calculateHash(y) || calculateHash(x) != calculateHash(literal) {
+		t.Fatal("structurally equal blocks hash differently")
+	}
+
+	// Every hashed field counts, and moving bytes across a field boundary is not a no-op
+	for name, changed := range map[string]Block{
+		"index":       {Index: 4, Timestamp: x.Timestamp, MerkleRoot: x.MerkleRoot, PrevHash: x.PrevHash, Nonce: 7, Difficulty: 2},
+		"nonce":       {Index: 3, Timestamp: x.Timestamp, MerkleRoot: x.MerkleRoot, PrevHash: x.PrevHash, Nonce: 8, Difficulty: 2},
+		"difficulty":  {Index: 3, Timestamp: x.Timestamp, MerkleRoot: x.MerkleRoot, PrevHash: x.PrevHash, Nonce: 7, Difficulty: 3},
+		"boundary":    {Index: 3, Timestamp: x.Timestamp, PrevHash: "cda", MerkleRoot: "b", Nonce: 7, Difficulty: 2},
+		"merkle root": {Index: 3, Timestamp: x.Timestamp, MerkleRoot: "ba", PrevHash: x.PrevHash, Nonce: 7, Difficulty: 2},
+		"prev hash":   {Index: 3, Timestamp: x.Timestamp, MerkleRoot: x.MerkleRoot, PrevHash: "dc", Nonce: 7, Difficulty: 2},
+		"timestamp":   {Index: 3, Timestamp: "2024-05-01T10:00:01Z", MerkleRoot: x.MerkleRoot, PrevHash: x.PrevHash, Nonce: 7, Difficulty: 2},
+	} {
+		if calculateHash(changed) == calculateHash(x) {
+			t.Errorf("changing %s left the hash unchanged", name)
+		}
+	}
+}
+
+// --- ACCESS CONTROL ---
+
+// postBlock sends b to HandleProposeBlock with apiKey on behalf of testValidator
+func postBlock(t *testing.T, apiKey string, b Block) *httptest.ResponseRecorder {
+	t.Helper()
+	data, err := json.Marshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("POST", "/block/propose", bytes.NewReader(data))
+	r.Header.Set("X-API-Key", apiKey)
+	r.Header.Set("X-Validator-ID", testValidator)
+	w := httptest.NewRecorder()
+	HandleProposeBlock(w, r)
+	return w
+}
+
+func TestProposeBlockBogusKeyForbidden(t *testing.T) {
+	key := newTestChain(t)
+	b := nextBlock(t, key, signedTx(newSender(t), "a", 1, 1))
+
+	if w := postBlock(t, "bogus-key", b); w.Code != http.StatusForbidden {
+		t.Fatalf("bogus key: status %d, want 403", w.Code)
+	}
+	if len(blockchain) != 1 {
+		t.Fatal("block committed with a bogus key")
+	}
+	if w := postBlock(t, "secret_admin", b); w.Code != http.StatusCreated {
+		t.Fatalf("admin key: status %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestCheckApiKeyLevels(t *testing.T) {
+	apiCredentialsMu.Lock()
+	apiCredentials["guest_key"] = AccessGuest
+	apiCredentialsMu.Unlock()
+	t.Cleanup(func() {
+		apiCredentialsMu.Lock()
+		delete(apiCredentials, "guest_key")
+		apiCredentialsMu.Unlock()
+	})
+
+	for key, want := range map[string]int{"secret_admin": AccessAdmin, "guest_key": AccessGuest, "": AccessGuest} {
+		if level, err := checkApiKey(key); err != nil || level != want {
+			t.Errorf("checkApiKey(%q) = %d, %v; want %d", key, level, err, want)
+		}
+	}
+	if _, err := checkApiKey("unknown"); !errors.Is(err, errUnknownAPIKey) {
+		t.Errorf("unknown key: %v, want errUnknownAPIKey", err)
+	}
+
+	key := newTestChain(t)
+	b := nextBlock(t, key)
+	for _, apiKey := range []string{"guest_key", "", "unknown"} {
+		if err := proposeBlock(context.Background(), apiKey, testValidator, b); err == nil || err.Status != http.StatusForbidden {
+			t.Errorf("proposal with %q: %v, want 403", apiKey, err)
+		}
+	}
+	if err := propose(b); err != nil {
+		t.Fatalf("admin proposal: %v", err)
+	}
+}
+
+// --- BLOCK REWARD ---
+
+func TestCoinbaseCorrectAmountAccepted(t *testing.T) {
+	key := newTestChain(t)
+	sender := newSender(t)
+	b := nextBlock(t, key, signedTx(sender, "a", 1, 3), signedTx(sender, "b", 2, 4))
+
+	if got, want := b.Transactions[0].Amount, BlockSubsidy+7; got != want {
+		t.Fatalf("coinbase amount %d, want %d", got, want)
+	}
+	if err := propose(b); err != nil {
+		t.Fatalf("propose: %v", err)
+	}
+	if _, err := validateChain(blockchain); err != nil {
+		t.Fatalf("chain invalid after commit: %v", err)
+	}
+}
+
+func TestCoinbaseTamperedAmountRejected(t *testing.T) {
+	key := newTestChain(t)
+	b := nextBlock(t, key, signedTx(newSender(t), "a", 1, 3))
+
+	// Re-seal so only the coinbase amount is wrong, not the hash or signature
+	b.Transactions[0].Amount++
+	b.MerkleRoot = MerkleRoot(b.Transactions)
+	b = sealBlock(b, b.Difficulty, key)
+
+	err := propose(b)
+	if err == nil || err.Status != http.StatusBadRequest || !strings.Contains(err.Message, "coinbase") {
+		t.Fatalf("propose = %v, want 400 invalid coinbase", err)
+	}
+	if len(blockchain) != 1 {
+		t.Fatalf("chain grew to %d blocks", len(blockchain))
+	}
+}
+
+func TestCoinbaseIDReservedForUserTransactions(t *testing.T) {
+	key := newTestChain(t)
+	forged := signedTx(newSender(t), coinbaseIDPrefix+"2", 1, 0)
+	if err := validateTransaction(forged); err == nil {
+		t.Fatal("user transaction with a coinbase ID was accepted")
+	}
+
+	// The reserved ID must leave block 2's coinbase free to commit
+	for i := 0; i < 2; i++ {
+		if err := propose(nextBlock(t, key)); err != nil {
+			t.Fatalf("block %d: %v", i+1, err)
+		}
+	}
+}
+
+// --- ROLLBACK ---
+
+// rollback posts to HandleRollbackBlock with apiKey
+func rollback(apiKey string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/block/rollback", nil)
+	r.Header.Set("X-API-Key", apiKey)
+	w := httptest.NewRecorder()
+	HandleRollbackBlock(w, r)
+	return w
+}
+
+func TestRollbackTipBlock(t *testing.T) {
+	buildChain(t, newTestChain(t), 2)
+	newTip := blockchain[1]
+
+	if w := rollback("unknown"); w.Code != http.StatusForbidden {
+		t.Fatalf("non-admin rollback: status %d, want 403", w.Code)
+	}
+	w := rollback("secret_admin")
+	if w.Code != http.StatusOK {
+		t.Fatalf("rollback: status %d: %s", w.Code, w.Body.String())
+	}
+	if len(blockchain) != 2 || blockchain[1].Hash != newTip.Hash {
+		t.Fatalf("chain has %d blocks after rollback, want 2", len(blockchain))
+	}
+	if _, ok := txIndex["tx-2"]; ok {
+		t.Error("rolled-back transaction still indexed")
+	}
+	if len(mempool) != 1 || mempool[0].ID != "tx-2" {
+		t.Errorf("mempool %v, want the rolled-back tx-2", mempool)
+	}
+}
+
+func TestRollbackRefusesGenesis(t *testing.T) {
+	newTestChain(t)
+	if w := rollback("secret_admin"); w.Code != http.StatusConflict {
+		t.Fatalf("genesis rollback: status %d, want 409", w.Code)
+	}
+	if len(blockchain) != 1 {
+		t.Fatal("genesis block removed")
+	}
+}
+
+// --- QUORUM ---
+
+func TestProposeQuorum(t *testing.T) {
+	key := newTestChain(t)
+	Quorum = 2
+	second := addTestValidator(t, "second_validator")
+	addTestValidator(t, "third_validator")
+
+	b := nextBlock(t, key)
+	own := ValidatorSig{Validator: testValidator, Sig: SignBlock(b, key)}
+	other := ValidatorSig{Validator: "second_validator", Sig: SignBlock(b, second)}
+
+	for name, sigs := range map[string][]ValidatorSig{
+		"below quorum":     {own},
+		"duplicate signer": {own, own},
+		"forged signer":    {own, {Validator: "third_validator", Sig: own.Sig}},
+	} {
+		b.ValidatorSigs = sigs
+		if err := propose(b); err == nil || err.Status != http.StatusForbidden {
+			t.Errorf("%s: %v, want 403", name, err)
+		}
+	}
+
+	b.ValidatorSigs = []ValidatorSig{own, other}
+	if err := propose(b); err != nil {
+		t.Fatalf("exactly quorum: %v", err)
+	}
+}
+
+// --- EXPORT / IMPORT ---
+
+// buildChain commits n blocks, each carrying one fresh transaction
+func buildChain(t *testing.T, key ed25519.PrivateKey, n int) {
+	t.Helper()
+	sender := newSender(t)
+	for i := 1; i <= n; i++ {
+		if err := propose(nextBlock(t, key, signedTx(sender, "tx-"+strconv.Itoa(i), i, i))); err != nil {
+			t.Fatalf("block %d: %v", i, err)
+		}
+	}
+}
+
+// importChain posts data to HandleImportChain as the admin
+func importChain(format string, data []byte) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/chain/import?format="+format, bytes.NewReader(data))
+	r.Header.Set("X-API-Key", "secret_admin")
+	w := httptest.NewRecorder()
+	HandleImportChain(w, r)
+	return w
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	for _, format := range []string{"json", "gob"} {
+		t.Run(format, func(t *testing.T) {
+			buildChain(t, newTestChain(t), 3)
+			want := append([]Block(nil), blockchain...)
+
+			w := httptest.NewRecorder()
+			HandleExportChain(w, httptest.NewRequest("GET", "/chain/export?format="+format, nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("export status %d: %s", w.Code, w.Body.String())
+			}
+
+			initChain()
+			if w := importChain(format, w.Body.Bytes()); w.Code != http.StatusOK {
+				t.Fatalf("import status %d: %s", w.Code, w.Body.String())
+			}
+			if !reflect.DeepEqual(blockchain, want) {
+				t.Fatal("imported chain differs from the exported one")
+			}
+		})
+	}
+}
+
+func TestImportRequiresValidatorQuorum(t *testing.T) {
+	buildChain(t, newTestChain(t), 2)
+	chain := append([]Block(nil), blockchain...)
+	chain[2].ValidatorSigs = nil
+
+	var buf bytes.Buffer
+	for _, b := range chain {
+		if err := writeGobBlock(&buf, b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	initChain()
+	if w := importChain("gob", buf.Bytes()); w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("import of an unsigned block: status %d, want 422", w.Code)
+	}
+	if len(blockchain) != 1 {
+		t.Fatalf("chain has %d blocks after a rejected import", len(blockchain))
+	}
+}
+
+// --- KEY ROTATION ---
+
+func TestRotatedKeyVerifiesOnlyWithinGraceWindow(t *testing.T) {
+	oldKey := newTestChain(t)
+	saved := KeyGraceWindow
+	t.Cleanup(func() { KeyGraceWindow = saved })
+
+	mutex.RLock()
+	chain := append([]Block(nil), blockchain...)
+	mutex.RUnlock()
+	before := blockOn(chain, time.Now().Add(-2*time.Second), oldKey)
+
+	v, _ := LookupValidator(testValidator)
+	v.RotateKey(base64.StdEncoding.EncodeToString(newSender(t).Public().(ed25519.PublicKey)))
+
+	KeyGraceWindow = time.Hour
+	if !v.ValidateBlock(before) {
+		t.Fatal("block signed before the rotation failed inside the grace window")
+	}
+	after := blockOn(chain, time.Now().Add(2*time.Second), oldKey)
+	if v.ValidateBlock(after) {
+		t.Fatal("block signed with the old key after the rotation verified")
+	}
+
+	KeyGraceWindow = 0
+	if v.ValidateBlock(before) {
+		t.Fatal("block signed before the rotation verified after the grace window")
+	}
+}
+
+// --- FORK RESOLUTION ---
+
+// rotateTestValidator gives testValidator a new key with the grace window already
+// closed on the old one, and returns the new key
+func rotateTestValidator(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+	saved := KeyGraceWindow
+	KeyGraceWindow = 0
+	t.Cleanup(func() { KeyGraceWindow = saved })
+
+	v, err := LookupValidator(testValidator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := newSender(t)
+	v.RotateKey(base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey)))
+	return key
+}
+
+// postChain sends candidate to HandleReplaceChain as the admin
+func postChain(t *testing.T, candidate []Block) *httptest.ResponseRecorder {
+	t.Helper()
+	data, err := json.Marshal(candidate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("POST", "/chain/replace", bytes.NewReader(data))
+	r.Header.Set("X-API-Key", "secret_admin")
+	w := httptest.NewRecorder()
+	HandleReplaceChain(w, r)
+	return w
+}
+
+func TestReplaceChainCandidates(t *testing.T) {
+	key := newTestChain(t)
+	buildChain(t, key, 2)
+	local := append([]Block(nil), blockchain...)
+
+	if w := postChain(t, local[:2]); w.Code != http.StatusConflict {
+		t.Errorf("shorter chain: status %d, want 409", w.Code)
+	}
+	if w := postChain(t, local); w.Code != http.StatusConflict {
+		t.Errorf("equal-length chain: status %d, want 409", w.Code)
+	}
+
+	longer := append(append([]Block(nil), local...), blockOn(local, time.Now().Add(time.Second), key))
+	invalid := append([]Block(nil), longer...)
+	invalid[2].Transactions = append([]Transaction(nil), invalid[2].Transactions...)
+	invalid[2].Transactions[1].Payload = "rewritten"
+	if w := postChain(t, invalid); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("invalid chain: status %d, want 422", w.Code)
+	}
+	if !reflect.DeepEqual(blockchain, local) {
+		t.Fatal("local chain changed after rejected candidates")
+	}
+
+	w := postChain(t, longer)
+	if w.Code != http.StatusOK {
+		t.Fatalf("longer chain: status %d: %s", w.Code, w.Body.String())
+	}
+	var resp map[string]int
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp["height"] != len(longer) || !reflect.DeepEqual(blockchain, longer) {
+		t.Fatalf("adopted height %d, chain length %d, want %d", resp["height"], len(blockchain), len(longer))
+	}
+}
+
+func TestReplaceChainAfterKeyRotation(t *testing.T) {
+	oldKey := newTestChain(t)
+	buildChain(t, oldKey, 2)
+	newKey := rotateTestValidator(t)
+
+	// A new proposal signed with the retired key is refused...
+	if err := propose(nextBlock(t, oldKey)); err == nil {
+		t.Fatal("block signed with a retired key was accepted after the grace window")
+	}
+
+	// ...but a peer's chain extending ours with older blocks under that key is adopted
+	peer := append([]Block(nil), blockchain...)
+	peer = append(peer, blockOn(peer, time.Now().Add(time.Second), newKey))
+	if _, err := replaceChain(peer); err != nil {
+		t.Fatalf("replaceChain: %v", err)
+	}
+
+	// A node without any of that history still verifies it against the key history
+	initChain()
+	if _, err := replaceChain(peer); err != nil {
+		t.Fatalf("replaceChain on a fresh node: %v", err)
+	}
+}
+
+func TestReplaceChainAfterDeactivation(t *testing.T) {
+	key := newTestChain(t)
+	buildChain(t, key, 2)
+	signed := append([]Block(nil), blockchain...)
+	v, _ := LookupValidator(testValidator)
+	v.SetActive(false)
+
+	// Blocks from before the deactivation still count toward quorum
+	initChain()
+	if _, err := replaceChain(signed); err != nil {
+		t.Fatalf("replaceChain: %v", err)
+	}
+
+	// Blocks signed after it do not
+	later := append(signed, blockOn(signed, time.Now().Add(time.Minute), key))
+	if _, err := replaceChain(later); err == nil {
+		t.Fatal("block signed after deactivation was adopted")
+	}
+}
+
+// --- TX SUBMISSION ---
+
+// submitTx posts body to /tx through the rate limiter from remoteAddr
+func submitTx(remoteAddr, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/tx", strings.NewReader(body))
+	r.RemoteAddr = remoteAddr
+	w := httptest.NewRecorder()
+	RateLimitMiddleware(TxLimiter, HandleSubmitTx)(w, r)
+	return w
+}
+
+// txJSON encodes tx as a request body
+func txJSON(t *testing.T, tx Transaction) string {
+	t.Helper()
+	data, err := json.Marshal(tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// withTxLimiter installs a fresh /tx limiter for the test
+func withTxLimiter(t *testing.T, rate, burst float64) {
+	t.Helper()
+	saved := TxLimiter
+	TxLimiter = &RateLimiter{Rate: rate, Burst: burst}
+	t.Cleanup(func() { TxLimiter = saved })
+}
+
+func TestSubmitTxBodyTooLarge(t *testing.T) {
+	newTestChain(t)
+	withTxLimiter(t, 1, 1)
+	tx := signedTx(newSender(t), "big", 1, 0)
+	tx.Payload = strings.Repeat("x", int(MaxTxBytes))
+
+	if w := submitTx("192.0.2.1:1000", txJSON(t, tx)); w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("status %d, want 413", w.Code)
+	}
+	if len(mempool) != 0 {
+		t.Fatalf("mempool holds %d transactions", len(mempool))
+	}
+}
+
+func TestSubmitTxMempoolFull(t *testing.T) {
+	newTestChain(t)
+	withTxLimiter(t, 1, 10)
+	saved := MaxMempoolSize
+	MaxMempoolSize = 2
+	t.Cleanup(func() { MaxMempoolSize = saved })
+
+	for i := 1; i <= 3; i++ {
+		w := submitTx("192.0.2.1:1000", txJSON(t, signedTx(newSender(t), "tx-"+strconv.Itoa(i), 1, 0)))
+		want := http.StatusAccepted
+		if i == 3 {
+			want = http.StatusServiceUnavailable
+		}
+		if w.Code != want {
+			t.Fatalf("tx %d: status %d, want %d", i, w.Code, want)
+		}
+	}
+	if len(mempool) != 2 {
+		t.Fatalf("mempool holds %d transactions, want 2", len(mempool))
+	}
+}
+
+func TestSubmitTxRateLimited(t *testing.T) {
+	newTestChain(t)
+	withTxLimiter(t, 0.001, 2)
+
+	for i := 1; i <= 2; i++ {
+		if w := submitTx("192.0.2.1:1000", txJSON(t, signedTx(newSender(t), "tx-"+strconv.Itoa(i), 1, 0))); w.Code != http.StatusAccepted {
+			t.Fatalf("tx %d: status %d", i, w.Code)
+		}
+	}
+	w := submitTx("192.0.2.1:1000", txJSON(t, signedTx(newSender(t), "tx-3", 1, 0)))
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("over the limit: status %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	if w := submitTx("192.0.2.2:1000", txJSON(t, signedTx(newSender(t), "tx-4", 1, 0))); w.Code != http.StatusAccepted {
+		t.Fatalf("another client was throttled: status %d", w.Code)
+	}
+}
+
+func TestAdminRequestBodyTooLarge(t *testing.T) {
+	newTestChain(t)
+	body := `{"url":"` + strings.Repeat("x", int(MaxRequestBytes)) + `"}`
+	for name, handler := range map[string]http.HandlerFunc{"peer": HandleAddPeer, "validator": HandleRegisterValidator} {
+		r := httptest.NewRequest("POST", "/", strings.NewReader(body))
+		r.Header.Set("X-API-Key", "secret_admin")
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("%s: status %d, want 413", name, w.Code)
+		}
+	}
+}
+
+// --- GRPC ---
+
+// serveTestGRPC serves impl as the Chain service in memory and returns the server
+// and a client connection using the JSON codec
+func serveTestGRPC(t *testing.T, impl ChainServer) (*grpc.Server, *grpc.ClientConn) {
+	t.Helper()
+	encoding.RegisterCodec(jsonCodec{})
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer()
+	srv.RegisterService(&chainServiceDesc, impl)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.CallContentSubtype("json")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return srv, conn
+}
+
+func TestGRPCProposeBlockJSONWireFormat(t *testing.T) {
+	key := newTestChain(t)
+	saved := ProposeLimiter
+	ProposeLimiter = &RateLimiter{Rate: 1, Burst: 5}
+	t.Cleanup(func() { ProposeLimiter = saved })
+	_, conn := serveTestGRPC(t, chainServer{})
+
+	// The documented wire format: plain JSON bodies and auth in metadata
+	b := nextBlock(t, key)
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-api-key", "secret_admin", "x-validator-id", testValidator)
+	var resp map[string]interface{}
+	if err := conn.Invoke(ctx, "/gochain.Chain/ProposeBlock", map[string]interface{}{"block": b}, &resp); err != nil {
+		t.Fatalf("ProposeBlock: %v", err)
+	}
+	if resp["status"] != "accepted" || resp["hash"] != b.Hash || resp["index"] != float64(b.Index) {
+		t.Fatalf("response %v", resp)
+	}
+	if len(blockchain) != 2 {
+		t.Fatalf("chain has %d blocks, want 2", len(blockchain))
+	}
+}
+
+// stuckServer is a Chain service whose proposals run until their RPC is cancelled
+type stuckServer struct{ entered chan struct{} }
+
+func (s stuckServer) ProposeBlock(ctx context.Context, req *BlockRequest) (*BlockResponse, error) {
+	close(s.entered)
+	<-ctx.Done() // GracefulStop alone would wait here forever
+	return nil, ctx.Err()
+}
+
+func TestStopGRPCBoundedByContext(t *testing.T) {
+	stuck := stuckServer{entered: make(chan struct{})}
+	srv, conn := serveTestGRPC(t, stuck)
+
+	callErr := make(chan error, 1)
+	go func() {
+		var resp BlockResponse
+		callErr <- conn.Invoke(context.Background(), "/gochain.Chain/ProposeBlock", &BlockRequest{}, &resp)
+	}()
+	<-stuck.entered
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	stopped := make(chan struct{})
+	go func() {
+		stopGRPC(ctx, srv)
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stopGRPC did not return after its context expired")
+	}
+	if err := <-callErr; err == nil {
+		t.Fatal("stuck call succeeded")
+	}
+}
+
+// --- CONCURRENCY ---
+
+func TestReadsDuringProposals(t *testing.T) {
+	key := newTestChain(t)
+	sender := newSender(t)
+
+	done := make(chan struct{})
+	errs := make(chan error, 4)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				for _, target := range []string{"/chain", "/block?index=0", "/tx/tx-1"} {
+					r := httptest.NewRequest("GET", target, nil)
+					r.SetPathValue("id", "tx-1")
+					w := httptest.NewRecorder()
+					switch {
+					case strings.HasPrefix(target, "/chain"):
+						HandleGetChain(w, r)
+					case strings.HasPrefix(target, "/block"):
+						HandleGetBlock(w, r)
+					default:
+						HandleGetTx(w, r)
+					}
+					if w.Code != http.StatusOK && w.Code != http.StatusNotFound {
+						errs <- fmt.Errorf("GET %s: status %d", target, w.Code)
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	for i := 1; i <= 5; i++ {
+		if err := propose(nextBlock(t, key, signedTx(sender, "tx-"+strconv.Itoa(i), i, 1))); err != nil {
+			t.Errorf("block %d: %v", i, err)
+		}
+	}
+	close(done)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if len(blockchain) != 6 {
+		t.Fatalf("chain has %d blocks, want 6", len(blockchain))
+	}
+}
+
+// --- MEMPOOL ---
+
+func TestAssembleBlockTakesHighestFees(t *testing.T) {
+	key := newTestChain(t)
+	saved := MaxTxPerBlock
+	MaxTxPerBlock = 2
+	t.Cleanup(func() { MaxTxPerBlock = saved })
+
+	mempoolMu.Lock()
+	for _, fee := range []int{1, 5, 3, 4} {
+		mempool = append(mempool, signedTx(newSender(t), "fee-"+strconv.Itoa(fee), 1, fee))
+	}
+	mempoolMu.Unlock()
+
+	b := assembleBlock(testValidator)
+	var ids []string
+	for _, tx := range b.Transactions[1:] {
+		ids = append(ids, tx.ID)
+	}
+	if want := []string{"fee-5", "fee-4"}; !reflect.DeepEqual(ids, want) {
+		t.Fatalf("block holds %v, want %v", ids, want)
+	}
+
+	if err := propose(sealBlock(b, b.Difficulty, key)); err != nil {
+		t.Fatalf("propose: %v", err)
+	}
+	var left []string
+	for _, tx := range mempool {
+		left = append(left, tx.ID)
+	}
+	if want := []string{"fee-1", "fee-3"}; !reflect.DeepEqual(left, want) {
+		t.Fatalf("mempool holds %v after commit, want %v", left, want)
+	}
+}
+
+func TestAssembleBlockKeepsSenderNonceOrder(t *testing.T) {
+	newTestChain(t)
+	sender := newSender(t)
+	mempoolMu.Lock()
+	mempool = append(mempool, signedTx(sender, "late", 2, 100), signedTx(sender, "early", 1, 1))
+	mempoolMu.Unlock()
+
+	b := assembleBlock(testValidator)
+	if len(b.Transactions) != 3 || b.Transactions[1].ID != "early" || b.Transactions[2].ID != "late" {
+		t.Fatalf("transactions not in nonce order: %+v", b.Transactions[1:])
+	}
+}
+
+// --- PROOF OF WORK ---
+
+func TestProposeRejectsMissingProofOfWork(t *testing.T) {
+	key := newTestChain(t)
+	Difficulty = 2
+	b := nextBlock(t, key)
+
+	// Claims difficulty 2 with a hash that only meets 1
+	for b.Nonce = 0; ; b.Nonce++ {
+		b.Hash = calculateHash(b)
+		if hasProofOfWork(b.Hash, 1) && !hasProofOfWork(b.Hash, 2) {
+			break
+		}
+	}
+	b.ValidatorSigs = []ValidatorSig{{Validator: testValidator, Sig: SignBlock(b, key)}}
+	if err := propose(b); err == nil || err.Status != http.StatusBadRequest {
+		t.Fatalf("block without proof of work: %v, want 400", err)
+	}
+
+	// Properly mined at 1 when 2 is required
+	if err := propose(sealBlock(b, 1, key)); err == nil || err.Reason != "bad_difficulty" {
+		t.Fatalf("block below the required difficulty: %v, want bad_difficulty", err)
+	}
+
+	if err := propose(sealBlock(b, 2, key)); err != nil {
+		t.Fatalf("block at the required difficulty: %v", err)
+	}
+}
+
+// retargetChain returns a chain of n blocks at difficulty, spaced interval apart
+func retargetChain(n, difficulty int, interval time.Duration) []Block {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	chain := make([]Block, n)
+	for i := range chain {
+		chain[i] = Block{Index: i, Timestamp: start.Add(time.Duration(i) * interval).Format(time.RFC3339), Difficulty: difficulty}
+	}
+	return chain
+}
+
+func TestDifficultyRetarget(t *testing.T) {
+	n := 2 * RetargetInterval
+	for _, tc := range []struct {
+		name       string
+		difficulty int
+		interval   time.Duration
+		want       int
+	}{
+		{"fast blocks", 3, time.Second, 4},
+		{"slow blocks", 3, 3 * TargetBlockTime, 2},
+		{"on target", 3, TargetBlockTime, 3},
+		{"fast at max", MaxDifficulty, time.Second, MaxDifficulty},
+		{"slow at min", MinDifficulty, 3 * TargetBlockTime, MinDifficulty},
+	} {
+		if got := nextDifficulty(retargetChain(n, tc.difficulty, tc.interval)); got != tc.want {
+			t.Errorf("%s: difficulty %d, want %d", tc.name, got, tc.want)
+		}
+	}
+
+	// Only every RetargetInterval blocks
+	if got := nextDifficulty(retargetChain(n+1, 3, time.Second)); got != 3 {
+		t.Errorf("between retargets: difficulty %d, want 3", got)
+	}
+}
+
+// --- PERSISTENCE ---
+
+func TestChainPersistsAcrossRestart(t *testing.T) {
+	key := newTestChain(t)
+	chainPath = filepath.Join(t.TempDir(), "chain.json")
+	buildChain(t, key, 3)
+	want := append([]Block(nil), blockchain...)
+
+	// A fresh start reloads the file, indexes included
+	initChain()
+	if err := loadChain(chainPath); err != nil {
+		t.Fatalf("loadChain: %v", err)
+	}
+	if !reflect.DeepEqual(blockchain, want) {
+		t.Fatal("reloaded chain differs from the saved one")
+	}
+	if txIndex["tx-2"] != 2 {
+		t.Errorf("tx-2 indexed at block %d, want 2", txIndex["tx-2"])
+	}
+	if err := propose(nextBlock(t, key)); err != nil {
+		t.Fatalf("propose after reload: %v", err)
+	}
+}
+
+func TestLoadChainMissingFileStartsAtGenesis(t *testing.T) {
+	buildChain(t, newTestChain(t), 1)
+	if err := loadChain(filepath.Join(t.TempDir(), "absent.json")); err != nil {
+		t.Fatalf("loadChain: %v", err)
+	}
+	if len(blockchain) != 1 || blockchain[0].Index != 0 {
+		t.Fatalf("chain has %d blocks, want genesis only", len(blockchain))
+	}
+}
+
+func TestLoadChainRejectsTamperedFile(t *testing.T) {
+	key := newTestChain(t)
+	chainPath = filepath.Join(t.TempDir(), "chain.json")
+	buildChain(t, key, 2)
+
+	data, err := os.ReadFile(chainPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := bytes.Replace(data, []byte("payload-tx-1"), []byte("payload-tx-X"), 1)
+	if err := os.WriteFile(chainPath, tampered, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadChain(chainPath); err == nil {
+		t.Fatal("tampered chain file loaded")
+	}
+}
+
+// --- DUPLICATES ---
+
+func TestProposeRejectsDuplicateTransaction(t *testing.T) {
+	key := newTestChain(t)
+	sender := newSender(t)
+	if err := propose(nextBlock(t, key, signedTx(sender, "a", 1, 1))); err != nil {
+		t.Fatal(err)
+	}
+
+	// Same ID in a later block, even with a fresh nonce
+	err := propose(nextBlock(t, key, signedTx(sender, "a", 2, 1)))
+	if err == nil || err.Status != http.StatusConflict || err.Message != "duplicate transaction" {
+		t.Fatalf("reused ID across blocks: %v, want 409 duplicate transaction", err)
+	}
+
+	// Same ID twice in one block
+	err = propose(nextBlock(t, key, signedTx(sender, "b", 2, 1), signedTx(sender, "b", 3, 1)))
+	if err == nil || err.Status != http.StatusConflict {
+		t.Fatalf("reused ID within a block: %v, want 409", err)
+	}
+	if len(blockchain) != 2 {
+		t.Fatalf("chain has %d blocks, want 2", len(blockchain))
+	}
+}
+
+// --- NONCES ---
+
+func TestReplayedNonceRejected(t *testing.T) {
+	key := newTestChain(t)
+	sender := newSender(t)
+	if err := propose(nextBlock(t, key, signedTx(sender, "a", 1, 1))); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, nonce := range []int{1, 0} {
+		err := propose(nextBlock(t, key, signedTx(sender, "b-"+strconv.Itoa(nonce), nonce, 1)))
+		if err == nil || err.Status != http.StatusConflict || err.Reason != "bad_nonce" {
+			t.Errorf("nonce %d: %v, want 409 bad_nonce", nonce, err)
+		}
+	}
+
+	withTxLimiter(t, 1, 1)
+	if w := submitTx("192.0.2.1:1000", txJSON(t, signedTx(sender, "c", 1, 1))); w.Code != http.StatusConflict {
+		t.Errorf("submitting a used nonce: status %d, want 409", w.Code)
+	}
+	if err := propose(nextBlock(t, key, signedTx(sender, "d", 2, 1))); err != nil {
+		t.Fatalf("next nonce: %v", err)
+	}
+}
+
+// --- BLOCK LIMITS ---
+
+func TestProposeRejectsOversizedBlock(t *testing.T) {
+	key := newTestChain(t)
+	savedCount, savedBytes := MaxBlockTxCount, MaxBlockBytes
+	t.Cleanup(func() { MaxBlockTxCount, MaxBlockBytes = savedCount, savedBytes })
+	MaxBlockTxCount = 2
+
+	sender := newSender(t)
+	b := nextBlock(t, key, signedTx(sender, "a", 1, 0), signedTx(sender, "b", 2, 0))
+	if err := propose(b); err == nil || err.Status != http.StatusRequestEntityTooLarge {
+		t.Fatalf("too many transactions: %v, want 413", err)
+	}
+
+	MaxBlockTxCount = savedCount
+	MaxBlockBytes = 256
+	if w := postBlock(t, "secret_admin", b); w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("body over MaxBlockBytes: status %d, want 413", w.Code)
+	}
+}
+
+func TestProposeEmptyBlockPolicy(t *testing.T) {
+	key := newTestChain(t)
+	saved := AllowEmptyBlocks
+	t.Cleanup(func() { AllowEmptyBlocks = saved })
+
+	AllowEmptyBlocks = false
+	if err := propose(nextBlock(t, key)); err == nil || err.Reason != "empty_block" {
+		t.Fatalf("empty block while disallowed: %v, want empty_block", err)
+	}
+	AllowEmptyBlocks = true
+	if err := propose(nextBlock(t, key)); err != nil {
+		t.Fatalf("empty block while allowed: %v", err)
+	}
+}
+
+// --- TIMESTAMPS ---
+
+func TestProposeTimestampRejections(t *testing.T) {
+	key := newTestChain(t)
+	if err := propose(nextBlock(t, key)); err != nil {
+		t.Fatal(err)
+	}
+	tip := blockchain[len(blockchain)-1]
+	tipTime, _ := time.Parse(time.RFC3339, tip.Timestamp)
+
+	unparseable := nextBlock(t, key)
+	unparseable.Timestamp = "yesterday"
+	unparseable = sealBlock(unparseable, unparseable.Difficulty, key)
+
+	for name, tc := range map[string]struct {
+		b    Block
+		want string
+	}{
+		"unparseable": {unparseable, "RFC3339"},
+		"future":      {blockOn(blockchain, time.Now().Add(MaxClockSkew+time.Minute), key), "future"},
+		"before tip":  {blockOn(blockchain, tipTime.Add(-time.Hour), key), "precedes"},
+	} {
+		err := propose(tc.b)
+		if err == nil || err.Status != http.StatusBadRequest || !strings.Contains(err.Message, tc.want) {
+			t.Errorf("%s: %v, want 400 mentioning %q", name, err, tc.want)
+		}
+	}
+	if err := propose(blockOn(blockchain, time.Now().Add(MaxClockSkew/2), key)); err != nil {
+		t.Errorf("timestamp within the allowed skew: %v", err)
+	}
+}
+
+// --- TRANSACTION VALIDATION ---
+
+func TestNegativeFeeRejected(t *testing.T) {
+	key := newTestChain(t)
+	sender := newSender(t)
+	neg := signedTx(sender, "neg", 1, -1)
+
+	err := propose(nextBlock(t, key, neg))
+	if err == nil || err.Status != http.StatusBadRequest || !strings.Contains(err.Message, "Transaction 1") {
+		t.Fatalf("block with a negative fee: %v, want 400 naming transaction 1", err)
+	}
+
+	withTxLimiter(t, 1, 1)
+	if w := submitTx("192.0.2.1:1000", txJSON(t, neg)); w.Code != http.StatusBadRequest {
+		t.Fatalf("submitting a negative fee: status %d, want 400", w.Code)
+	}
+}
+
+func TestFeeOverflowRejected(t *testing.T) {
+	key := newTestChain(t)
+	sender := newSender(t)
+	// Unchecked, these two fees sum to a negative coinbase amount
+	a := signedTx(sender, "a", 1, math.MaxInt-1)
+	b := signedTx(sender, "b", 2, math.MaxInt-1)
+
+	err := propose(nextBlock(t, key, a, b))
+	if err == nil || err.Status != http.StatusBadRequest || !strings.Contains(err.Message, "Transaction 1") {
+		t.Fatalf("block with overflowing fees: %v, want 400 naming transaction 1", err)
+	}
+
+	withTxLimiter(t, 1, 1)
+	if w := submitTx("192.0.2.1:1000", txJSON(t, a)); w.Code != http.StatusBadRequest {
+		t.Fatalf("submitting a fee above MaxFee: status %d, want 400", w.Code)
+	}
+	if err := propose(nextBlock(t, key, signedTx(sender, "max", 1, MaxFee))); err != nil {
+		t.Fatalf("fee at MaxFee: %v", err)
+	}
+}
+
+// --- REQUIRED FIELDS ---
+
+func TestProposeRejectsMissingFields(t *testing.T) {
+	key := newTestChain(t)
+	for name, tc := range map[string]struct {
+		mutate func(*Block)
+		want   string
+	}{
+		"timestamp": {func(b *Block) { b.Timestamp = "" }, "timestamp is required"},
+		"prev_hash": {func(b *Block) { b.PrevHash = "" }, "prev_hash is required"},
+		"hash":      {func(b *Block) { b.Hash = "" }, "hash is required"},
+		"mismatch":  {func(b *Block) { b.Hash = strings.Repeat("0", len(b.Hash)) }, "hash does not match"},
+	} {
+		b := nextBlock(t, key)
+		tc.mutate(&b)
+		err := propose(b)
+		if err == nil || err.Status != http.StatusBadRequest || !strings.Contains(err.Message, tc.want) {
+			t.Errorf("%s: %v, want 400 mentioning %q", name, err, tc.want)
+		}
+	}
+	if len(blockchain) != 1 {
+		t.Fatalf("chain grew to %d blocks", len(blockchain))
+	}
+}
+
+// --- LOGGING ---
+
+// logLines serves r through LoggingMiddleware and h and returns the log lines it wrote
+func logLines(t *testing.T, h http.HandlerFunc, r *http.Request) []map[string]interface{} {
+	t.Helper()
+	var buf bytes.Buffer
+	saved := logger
+	logger = slog.New(slog.NewJSONHandler(&buf, nil))
+	defer func() { logger = saved }()
+
+	LoggingMiddleware(h).ServeHTTP(httptest.NewRecorder(), r)
+	var lines []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var m map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &m); err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, m)
+	}
+	return lines
+}
+
+func TestRequestLogAccessLevel(t *testing.T) {
+	newTestChain(t)
+	admin := func(w http.ResponseWriter, r *http.Request) {
+		if requireAdmin(w, r, "test") {
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}
+	public := func(w http.ResponseWriter, r *http.Request) {}
+
+	for name, tc := range map[string]struct {
+		h    http.HandlerFunc
+		key  string
+		want string
+	}{
+		"admin":   {admin, "secret_admin", strconv.Itoa(AccessAdmin)},
+		"guest":   {admin, "", strconv.Itoa(AccessGuest)},
+		"unknown": {admin, "bogus", "invalid"},
+		"public":  {public, "secret_admin", "none"},
+	} {
+		r := httptest.NewRequest("POST", "/peers", nil)
+		r.Header.Set("X-API-Key", tc.key)
+		r.Header.Set("X-Request-ID", "req-"+name)
+		lines := logLines(t, tc.h, r)
+		last := lines[len(lines)-1]
+		if last["access_level"] != tc.want {
+			t.Errorf("%s: access_level %v, want %q", name, last["access_level"], tc.want)
+		}
+		for _, line := range lines {
+			if line["request_id"] != "req-"+name {
+				t.Errorf("%s: %q logged with request_id %v", name, line["msg"], line["request_id"])
+			}
+		}
+	}
+}
@@ -1,271 +1,3215 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"math"
+	"mime"
+	"net"
 	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode/utf8"
 
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/time/rate"
 )
 
 // --- CONFIGURATION ---
-const DBName = "./ledger.db"
+
+// Config holds the settings that vary between deployments, read from the environment
+type Config struct {
+	DBPath       string        // LEDGER_DB_PATH
+	Addr         string        // LEDGER_ADDR
+	RefundWindow time.Duration // LEDGER_REFUND_WINDOW, e.g. "30m"
+	DailyLimit   int64         // LEDGER_DAILY_LIMIT, in minor units
+	CORSOrigins  []string      // LEDGER_CORS_ORIGINS, comma-separated, e.g. "https://dash.example.com"
+	TLSCert      string        // LEDGER_TLS_CERT, path to the PEM certificate
+	TLSKey       string        // LEDGER_TLS_KEY, path to the PEM private key
+
+	// LEDGER_TRANSFER_BOUNDS, comma-separated CODE:MIN:MAX in minor units,
+	// e.g. "USD:1:1000000,EUR:100:500000". Listed currencies override the defaults.
+	TransferBounds map[string]AmountBounds
+
+	Fees         FeeSchedule // LEDGER_FEE_FLAT, LEDGER_FEE_BPS, LEDGER_FEE_MIN
+	FeeCollector int         // LEDGER_FEE_COLLECTOR, user id credited with fees
+	RefundFees   bool        // LEDGER_REFUND_FEES, return the fee when a transfer is refunded
+}
+
+// TLSEnabled reports whether the server should listen with HTTPS
+func (c Config) TLSEnabled() bool {
+	return c.TLSCert != ""
+}
+
+// loadConfig reads Config from the environment, using defaults for unset variables
+func loadConfig() (Config, error) {
+	cfg := Config{
+		DBPath:       "./ledger.db",
+		Addr:         ":8080",
+		RefundWindow: RefundWindow,
+		DailyLimit:   DailyTransferLimit,
+
+		TransferBounds: map[string]AmountBounds{},
+	}
+	for code, b := range TransferBounds {
+		cfg.TransferBounds[code] = b
+	}
+	if v := os.Getenv("LEDGER_DB_PATH"); v != "" {
+		cfg.DBPath = v
+	}
+	if v := os.Getenv("LEDGER_ADDR"); v != "" {
+		cfg.Addr = v
+	}
+	if v := os.Getenv("LEDGER_REFUND_WINDOW"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return cfg, fmt.Errorf("LEDGER_REFUND_WINDOW must be a positive duration like \"1h\", got %q", v)
+		}
+		cfg.RefundWindow = d
+	}
+	if v := os.Getenv("LEDGER_DAILY_LIMIT"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			return cfg, fmt.Errorf("LEDGER_DAILY_LIMIT must be a positive integer in minor units, got %q", v)
+		}
+		cfg.DailyLimit = n
+	}
+	for _, entry := range strings.Split(os.Getenv("LEDGER_TRANSFER_BOUNDS"), ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		parts := strings.Split(entry, ":")
+		if len(parts) != 3 {
+			return cfg, fmt.Errorf("LEDGER_TRANSFER_BOUNDS entries must look like USD:1:1000000, got %q", entry)
+		}
+		min, errMin := strconv.ParseInt(parts[1], 10, 64)
+		max, errMax := strconv.ParseInt(parts[2], 10, 64)
+		if errMin != nil || errMax != nil || min < 1 || max < min || max > MaxTransferAmount {
+			return cfg, fmt.Errorf("LEDGER_TRANSFER_BOUNDS entry %q needs 1 <= MIN <= MAX <= %d", entry, MaxTransferAmount)
+		}
+		cfg.TransferBounds[strings.ToUpper(parts[0])] = AmountBounds{Min: min, Max: max}
+	}
+	for name, dst := range map[string]*int64{"LEDGER_FEE_FLAT": &cfg.Fees.Flat, "LEDGER_FEE_BPS": &cfg.Fees.BasisPoints, "LEDGER_FEE_MIN": &cfg.Fees.Min} {
+		if v := os.Getenv(name); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 0 || n > MaxTransferAmount {
+				return cfg, fmt.Errorf("%s must be an integer between 0 and %d, got %q", name, MaxTransferAmount, v)
+			}
+			*dst = n
+		}
+	}
+	if cfg.Fees.BasisPoints > 10000 {
+		return cfg, fmt.Errorf("LEDGER_FEE_BPS must be at most 10000 (100%%), got %d", cfg.Fees.BasisPoints)
+	}
+	if v := os.Getenv("LEDGER_FEE_COLLECTOR"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return cfg, fmt.Errorf("LEDGER_FEE_COLLECTOR must be a user id, got %q", v)
+		}
+		cfg.FeeCollector = n
+	}
+	if cfg.Fees != (FeeSchedule{}) && cfg.FeeCollector == 0 {
+		return cfg, errors.New("LEDGER_FEE_COLLECTOR must be set when transfer fees are configured")
+	}
+	if v := os.Getenv("LEDGER_REFUND_FEES"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return cfg, fmt.Errorf("LEDGER_REFUND_FEES must be true or false, got %q", v)
+		}
+		cfg.RefundFees = b
+	}
+	cfg.TLSCert, cfg.TLSKey = os.Getenv("LEDGER_TLS_CERT"), os.Getenv("LEDGER_TLS_KEY")
+	if (cfg.TLSCert == "") != (cfg.TLSKey == "") {
+		return cfg, errors.New("LEDGER_TLS_CERT and LEDGER_TLS_KEY must be set together")
+	}
+	for _, origin := range strings.Split(os.Getenv("LEDGER_CORS_ORIGINS"), ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			cfg.CORSOrigins = append(cfg.CORSOrigins, origin)
+		}
+	}
+	return cfg, nil
+}
+
+// ShutdownTimeout bounds how long in-flight requests may run after SIGTERM
+const ShutdownTimeout = 30 * time.Second
+
+// IdempotencyTTL is how long a processed Idempotency-Key is remembered per user
+const IdempotencyTTL = 24 * time.Hour
+
+// RefundWindow is how long after a transfer it can still be refunded (LEDGER_REFUND_WINDOW)
+var RefundWindow = time.Hour
+
+// MaxTransferAmount is the largest single transfer accepted, in minor units ($1,000,000.00).
+// It keeps crafted amounts far away from int64 overflow.
+const MaxTransferAmount int64 = 100000000
+
+// DailyTransferLimit caps a user's outgoing transfers per UTC day, in minor units ($1,000.00 by default, LEDGER_DAILY_LIMIT)
+var DailyTransferLimit int64 = 100000
+
+// AmountBounds is the smallest and largest single transfer allowed in a currency, in minor units
+type AmountBounds struct {
+	Min, Max int64
+}
+
+// TransferBounds holds per-currency transfer bounds (LEDGER_TRANSFER_BOUNDS). Currencies
+// not listed are only limited by MaxTransferAmount.
+var TransferBounds = map[string]AmountBounds{
+	"USD": {Min: 1, Max: 1000000}, // $0.01 to $10,000.00
+	"EUR": {Min: 1, Max: 1000000},
+	"GBP": {Min: 1, Max: 1000000},
+}
+
+// FeeSchedule prices a transfer, a bulk transfer item, or a captured hold. The fee is
+// Flat + amount*BasisPoints/10000, but never less than Min; all in minor units.
+// The zero schedule charges nothing.
+type FeeSchedule struct {
+	Flat        int64
+	BasisPoints int64 // 1 basis point = 0.01%
+	Min         int64
+}
+
+// Fee returns the fee charged on a transfer of amount
+func (f FeeSchedule) Fee(amount int64) int64 {
+	if f == (FeeSchedule{}) {
+		return 0
+	}
+	return max(f.Min, f.Flat+amount*f.BasisPoints/10000)
+}
+
+// Transfer fee settings (LEDGER_FEE_FLAT, LEDGER_FEE_BPS, LEDGER_FEE_MIN, LEDGER_FEE_COLLECTOR,
+// LEDGER_REFUND_FEES). Fees are credited to the FeeCollectorID account; RefundFees decides
+// whether a refund also returns the fee.
+var (
+	Fees           FeeSchedule
+	FeeCollectorID int
+	RefundFees     bool
+)
+
+// MaxVersionRetries is how many times a transfer is attempted when the sender's or
+// recipient's account keeps changing underneath it, before giving up with 409
+const MaxVersionRetries = 3
+
+// MaxBulkTransferItems caps how many transfers one bulk request may contain
+const MaxBulkTransferItems = 500
+
+// Per-API-key token bucket used by RateLimitMiddleware
+var (
+	RateLimit rate.Limit = 10 // Requests per second
+	RateBurst            = 20
+)
 
 // --- DATABASE MODELS ---
 type User struct {
 	ID       int    `json:"id"`
 	Username string `json:"username"`
-	Balance  int64  `json:"balance"` // Stored in cents
+	Balance  Money  `json:"balance"` // Stored in cents
 	APIKey   string `json:"-"`
+	Role     string `json:"role"`   // RoleUser or RoleAdmin
+	Frozen   bool   `json:"frozen"` // Frozen accounts cannot send money or issue refunds
+}
+
+type Transaction struct {
+	ID         int    `json:"id"`
+	FromUser   int    `json:"from_user"`
+	ToUser     int    `json:"to_user"`
+	Amount     Money  `json:"amount"`
+	Timestamp  string `json:"timestamp"`
+	Status     string `json:"status"`                // 'PENDING', 'COMPLETED', 'RELEASED', 'REFUNDED', 'REVERSAL', 'FEE'
+	RefundedBy int    `json:"refunded_by,omitempty"` // User who issued the refund (sender or admin)
+	Memo       string `json:"memo,omitempty"`        // Optional invoice number or note
+
+	// Set on REVERSAL rows: the refunded transaction this entry reverses
+	RefundTransactionID int `json:"refund_transaction_id,omitempty"`
+	// Set on FEE rows: the transfer the fee was charged on
+	ParentTransactionID int `json:"parent_transaction_id,omitempty"`
+}
+
+// transactionStatuses are the values Transaction.Status can take
+var transactionStatuses = map[string]bool{"PENDING": true, "COMPLETED": true, "RELEASED": true, "REFUNDED": true, "REVERSAL": true, "FEE": true}
+
+// MaxMemoLength is the longest memo accepted on a transfer, in characters
+const MaxMemoLength = 140
+
+// transactionColumns is the column list read by scanTransaction
+const transactionColumns = "id, from_user, to_user, amount, currency, timestamp, status, refunded_by, memo, refund_transaction_id, parent_transaction_id"
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanTransaction reads a row selected with transactionColumns
+func scanTransaction(row rowScanner) (Transaction, error) {
+	var t Transaction
+	var refundedBy, refundOf, parent sql.NullInt64
+	var memo sql.NullString
+	err := row.Scan(&t.ID, &t.FromUser, &t.ToUser, &t.Amount, &t.Amount.Currency, &t.Timestamp, &t.Status, &refundedBy, &memo, &refundOf, &parent)
+	t.RefundedBy = int(refundedBy.Int64)
+	t.Memo = memo.String
+	t.RefundTransactionID = int(refundOf.Int64)
+	t.ParentTransactionID = int(parent.Int64)
+	return t, err
+}
+
+// Roles stored in users.role
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+// --- MONEY ---
+
+// DefaultCurrency is the currency of every account until multi-currency lands
+const DefaultCurrency = "USD"
+
+// Money is an amount in minor units (cents) of a 3-letter ISO currency
+type Money struct {
+	Amount   int64  `json:"amount"`
+	Currency string `json:"currency"`
+}
+
+var currencySymbols = map[string]string{
+	"USD": "$",
+	"EUR": "€",
+	"GBP": "£",
+}
+
+// Add returns m + o; both must share a currency
+func (m Money) Add(o Money) (Money, error) {
+	if m.Currency != o.Currency {
+		return Money{}, fmt.Errorf("currency mismatch: %s vs %s", m.Currency, o.Currency)
+	}
+	sum, ok := checkedAdd(m.Amount, o.Amount)
+	if !ok {
+		return Money{}, errors.New("amount overflow")
+	}
+	return Money{Amount: sum, Currency: m.Currency}, nil
+}
+
+// Sub returns m - o; both must share a currency
+func (m Money) Sub(o Money) (Money, error) {
+	if m.Currency != o.Currency {
+		return Money{}, fmt.Errorf("currency mismatch: %s vs %s", m.Currency, o.Currency)
+	}
+	if o.Amount == math.MinInt64 {
+		return Money{}, errors.New("amount overflow")
+	}
+	diff, ok := checkedAdd(m.Amount, -o.Amount)
+	if !ok {
+		return Money{}, errors.New("amount overflow")
+	}
+	return Money{Amount: diff, Currency: m.Currency}, nil
+}
+
+// checkedAdd returns a + b and false if the result overflows int64
+func checkedAdd(a, b int64) (int64, bool) {
+	if (b > 0 && a > math.MaxInt64-b) || (b < 0 && a < math.MinInt64-b) {
+		return 0, false
+	}
+	return a + b, true
+}
+
+// String renders the amount for humans, e.g. "$100.00" or "-12.50 CHF"
+func (m Money) String() string {
+	sign := ""
+	amount := m.Amount
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+	value := fmt.Sprintf("%d.%02d", amount/100, amount%100)
+	if symbol, ok := currencySymbols[m.Currency]; ok {
+		return sign + symbol + value
+	}
+	return sign + value + " " + m.Currency
+}
+
+// MarshalJSON encodes Money as {"amount": <minor units>, "currency": "USD"}
+func (m Money) MarshalJSON() ([]byte, error) {
+	type plain Money
+	return json.Marshal(plain(m))
+}
+
+// UnmarshalJSON accepts the object form, or a bare integer of minor units in DefaultCurrency
+func (m *Money) UnmarshalJSON(data []byte) error {
+	var minor int64
+	if err := json.Unmarshal(data, &minor); err == nil {
+		*m = Money{Amount: minor, Currency: DefaultCurrency}
+		return nil
+	}
+
+	type plain Money
+	var p plain
+	if err := json.Unmarshal(data, &p); err != nil {
+		return err
+	}
+	if len(p.Currency) != 3 {
+		return fmt.Errorf("invalid currency code %q", p.Currency)
+	}
+	*m = Money(p)
+	return nil
+}
+
+// Scan reads a minor-units INTEGER column; the currency defaults to DefaultCurrency.
+// Queries that select a currency column scan it into Currency after the amount.
+func (m *Money) Scan(src interface{}) error {
+	amount, ok := src.(int64)
+	if !ok {
+		return fmt.Errorf("cannot scan %T into Money", src)
+	}
+	*m = Money{Amount: amount, Currency: DefaultCurrency}
+	return nil
+}
+
+// Global DB instance
+var db *sql.DB
+
+// startTime is used to report process uptime
+var startTime = time.Now()
+
+// --- INITIALIZATION ---
+func initDB(dbPath string) {
+	var err error
+	// SQLite concurrency settings:
+	//   _busy_timeout=5000  wait up to 5s for a lock instead of failing with "database is locked".
+	//                       It is per connection, so it goes in the DSN to cover every pooled connection.
+	//   _txlock=immediate   BEGIN IMMEDIATE takes the write lock up front, so a transaction that reads
+	//                       then writes waits its turn rather than failing on the lock upgrade.
+	db, err = sql.Open("sqlite3", dbPath+"?_busy_timeout=5000&_txlock=immediate")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// WAL lets readers (auth lookups, balances, statements) proceed while a transfer
+	// holds the write lock. The mode is stored in the database file.
+	if _, err := db.Exec("PRAGMA journal_mode=WAL"); err != nil {
+		log.Fatal(err)
+	}
+	// SQLite allows a single writer; a small pool keeps readers concurrent
+	// without piling up connections that would only queue on the write lock.
+	db.SetMaxOpenConns(4)
+
+	if err := migrate(); err != nil {
+		log.Fatalf("Migrating database: %v", err)
+	}
+
+	// Seed data check
+	var count int
+	db.QueryRow("SELECT count(*) FROM users").Scan(&count)
+	if count == 0 {
+		db.Exec("INSERT INTO users (username, balance, opening_balance, api_key_hash, currency) VALUES (?, ?, ?, ?, ?)", "alice", 10000, 10000, hashAPIKey("secret_alice_123"), DefaultCurrency) // $100.00
+		db.Exec("INSERT INTO users (username, balance, opening_balance, api_key_hash, currency) VALUES (?, ?, ?, ?, ?)", "bob", 5000, 5000, hashAPIKey("secret_bob_456"), DefaultCurrency)       // $50.00
+		db.Exec("INSERT INTO users (username, balance, opening_balance, api_key_hash, currency) VALUES (?, ?, ?, ?, ?)", "mallory", 1000, 1000, hashAPIKey("secret_mal_789"), DefaultCurrency)   // $10.00
+		db.Exec("INSERT INTO users (username, balance, opening_balance, api_key_hash, currency, role) VALUES (?, ?, ?, ?, ?, ?)", "support", 0, 0, hashAPIKey("secret_support_000"), DefaultCurrency, RoleAdmin)
+	}
+}
+
+// hashAPIKey returns the SHA-256 digest of an API Key. Only digests are stored,
+// so a database leak does not expose usable credentials.
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// --- MIGRATIONS ---
+
+// migration is one schema change. Each runs once, in order, inside its own transaction,
+// and is recorded in schema_migrations. Add new changes to the end of migrations; never
+// edit one that has shipped.
+type migration struct {
+	Version int
+	Name    string
+	Up      func(tx *sql.Tx) error
+}
+
+var migrations = []migration{
+	{1, "create users and transactions", execAll(
+		`CREATE TABLE IF NOT EXISTS users (id INTEGER PRIMARY KEY, username TEXT, balance INTEGER, api_key TEXT)`,
+		`CREATE TABLE IF NOT EXISTS transactions (id INTEGER PRIMARY KEY, from_user INTEGER, to_user INTEGER, amount INTEGER, timestamp TEXT, status TEXT)`,
+	)},
+	{2, "add users.role", func(tx *sql.Tx) error {
+		if err := ensureColumn(tx, "users", "role", "TEXT NOT NULL DEFAULT 'user'"); err != nil {
+			return err
+		}
+		// Databases from before roles flagged admins with is_admin; carry that over
+		has, err := hasColumn(tx, "users", "is_admin")
+		if err != nil || !has {
+			return err
+		}
+		_, err = tx.Exec("UPDATE users SET role = ?, is_admin = 0 WHERE is_admin = 1", RoleAdmin)
+		return err
+	}},
+	{3, "add transactions.refunded_by", addColumn("transactions", "refunded_by", "INTEGER")},
+	{4, "add currencies", func(tx *sql.Tx) error {
+		if err := ensureColumn(tx, "users", "currency", "TEXT NOT NULL DEFAULT 'USD'"); err != nil {
+			return err
+		}
+		return ensureColumn(tx, "transactions", "currency", "TEXT NOT NULL DEFAULT 'USD'")
+	}},
+	{5, "create idempotency_keys", execAll(
+		`CREATE TABLE IF NOT EXISTS idempotency_keys (key TEXT, user_id INTEGER, request_hash TEXT, response_body TEXT, created_at TEXT, PRIMARY KEY (key, user_id))`,
+	)},
+	{6, "add transactions.memo", addColumn("transactions", "memo", "TEXT")},
+	{7, "hash API keys", func(tx *sql.Tx) error {
+		if err := ensureColumn(tx, "users", "api_key_hash", "TEXT"); err != nil {
+			return err
+		}
+		return hashPlaintextAPIKeys(tx)
+	}},
+	{8, "add users.frozen", addColumn("users", "frozen", "INTEGER NOT NULL DEFAULT 0")},
+	// Usernames identify accounts, so they must be unique
+	{9, "unique usernames", execAll("CREATE UNIQUE INDEX IF NOT EXISTS idx_users_username ON users(username)")},
+	{10, "add users.held", addColumn("users", "held", "INTEGER NOT NULL DEFAULT 0")},
+	{11, "create webhooks", execAll(
+		`CREATE TABLE IF NOT EXISTS webhooks (user_id INTEGER PRIMARY KEY, url TEXT NOT NULL, secret TEXT NOT NULL)`,
+		`CREATE TABLE IF NOT EXISTS webhook_deliveries (id INTEGER PRIMARY KEY, user_id INTEGER NOT NULL, transaction_id INTEGER, event_type TEXT, payload TEXT NOT NULL, status TEXT NOT NULL DEFAULT 'PENDING', attempts INTEGER NOT NULL DEFAULT 0, last_error TEXT, next_attempt_at TEXT, created_at TEXT, updated_at TEXT)`,
+	)},
+	{12, "add users.opening_balance", func(tx *sql.Tx) error {
+		if err := ensureColumn(tx, "users", "opening_balance", "INTEGER"); err != nil {
+			return err
+		}
+		return backfillOpeningBalances(tx)
+	}},
+	// AuthMiddleware looks up every request by key hash, and statements filter by sender or recipient
+	{13, "index auth and statement lookups", execAll(
+		"CREATE INDEX IF NOT EXISTS idx_users_api_key_hash ON users(api_key_hash)",
+		"CREATE INDEX IF NOT EXISTS idx_txn_from ON transactions(from_user)",
+		"CREATE INDEX IF NOT EXISTS idx_txn_to ON transactions(to_user)",
+	)},
+	// Bumped on every balance or held change. Transfers read it with the balances and
+	// only write if it is unchanged, retrying or failing with 409 otherwise.
+	{14, "add users.version", addColumn("users", "version", "INTEGER NOT NULL DEFAULT 0")},
+	{15, "add refund reversal rows", func(tx *sql.Tx) error {
+		if err := ensureColumn(tx, "transactions", "refund_transaction_id", "INTEGER"); err != nil {
+			return err
+		}
+		// Earlier refunds only flipped the status; give each a reversal entry. When the
+		// refund happened wasn't recorded, so it takes the original's timestamp.
+		_, err := tx.Exec(`INSERT INTO transactions (from_user, to_user, amount, currency, timestamp, status, refunded_by, refund_transaction_id)
+			SELECT from_user, to_user, -amount, currency, timestamp, 'REVERSAL', refunded_by, id FROM transactions t
+			WHERE status = 'REFUNDED' AND NOT EXISTS (SELECT 1 FROM transactions r WHERE r.refund_transaction_id = t.id)`)
+		return err
+	}},
+	{16, "add transactions.parent_transaction_id", addColumn("transactions", "parent_transaction_id", "INTEGER")},
+}
+
+// migrate applies every migration not yet recorded in schema_migrations.
+// Migrations are written to be safe on databases that predate this table,
+// whose schema already contains some of the changes.
+func migrate() error {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY, name TEXT, applied_at TEXT)`); err != nil {
+		return err
+	}
+
+	applied := map[int]bool{}
+	rows, err := db.Query("SELECT version FROM schema_migrations")
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var v int
+		if err := rows.Scan(&v); err != nil {
+			rows.Close()
+			return err
+		}
+		applied[v] = true
+	}
+	rows.Close()
+
+	for _, m := range migrations {
+		if applied[m.Version] {
+			continue
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if err := m.Up(tx); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d (%s): %w", m.Version, m.Name, err)
+		}
+		if _, err := tx.Exec("INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)", m.Version, m.Name, time.Now().UTC().Format(time.RFC3339)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		log.Printf("Applied migration %d: %s", m.Version, m.Name)
+	}
+	return nil
+}
+
+// execAll returns a migration step running each statement in order
+func execAll(stmts ...string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		for _, q := range stmts {
+			if _, err := tx.Exec(q); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// addColumn returns a migration step adding one column
+func addColumn(table, column, definition string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		return ensureColumn(tx, table, column, definition)
+	}
+}
+
+// hashPlaintextAPIKeys moves every plaintext api_key into api_key_hash and clears it,
+// for databases created before keys were hashed.
+func hashPlaintextAPIKeys(tx *sql.Tx) error {
+	rows, err := tx.Query("SELECT id, api_key FROM users WHERE api_key IS NOT NULL AND api_key_hash IS NULL")
+	if err != nil {
+		return err
+	}
+	plaintext := map[int]string{}
+	for rows.Next() {
+		var id int
+		var key string
+		if err := rows.Scan(&id, &key); err != nil {
+			rows.Close()
+			return err
+		}
+		plaintext[id] = key
+	}
+	rows.Close()
+
+	for id, key := range plaintext {
+		if _, err := tx.Exec("UPDATE users SET api_key_hash = ?, api_key = NULL WHERE id = ?", hashAPIKey(key), id); err != nil {
+			return err
+		}
+	}
+	if len(plaintext) > 0 {
+		log.Printf("Hashed %d plaintext API keys", len(plaintext))
+	}
+	return nil
+}
+
+// backfillOpeningBalances derives opening balances for accounts created before they were
+// recorded, assuming the current balance is explained by the account's completed transfers.
+func backfillOpeningBalances(tx *sql.Tx) error {
+	_, err := tx.Exec(`UPDATE users SET opening_balance = balance - COALESCE((
+		SELECT SUM(CASE WHEN to_user = users.id THEN amount ELSE -amount END)
+		FROM transactions WHERE status = 'COMPLETED' AND (from_user = users.id OR to_user = users.id)
+	), 0) WHERE opening_balance IS NULL`)
+	return err
+}
+
+// ensureColumn adds a column to an existing table if it is missing
+func ensureColumn(tx *sql.Tx, table, column, definition string) error {
+	has, err := hasColumn(tx, table, column)
+	if err != nil || has {
+		return err
+	}
+	_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
+// hasColumn reports whether a table currently has the given column
+func hasColumn(tx *sql.Tx, table, column string) (bool, error) {
+	rows, err := tx.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dflt, &pk); err != nil {
+			return false, err
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
+// --- RESPONSES ---
+
+// writeError sends a JSON error body with a stable machine-readable code:
+// {"error":{"code":"insufficient_funds","message":"Insufficient funds"}}
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]string{"code": code, "message": message},
+	})
+}
+
+// Request body limits for decodeJSONBody
+const (
+	MaxBodyBytes     = 64 << 10 // 64KB
+	MaxBulkBodyBytes = 1 << 20  // 1MB, enough for MaxBulkTransferItems with memos
+)
+
+// decodeJSONBody decodes a size-limited JSON body into v, rejecting unknown fields
+// so typos like "amt" fail loudly. The request must declare Content-Type: application/json.
+// On failure it writes the error response and returns false.
+func decodeJSONBody(w http.ResponseWriter, r *http.Request, v interface{}, maxBytes int64) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/json" {
+		writeError(w, http.StatusUnsupportedMediaType, "unsupported_media_type", "Content-Type must be application/json")
+		return false
+	}
+
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBytes))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		if errors.Is(err, io.EOF) {
+			writeError(w, http.StatusBadRequest, "empty_body", "empty request body")
+			return false
+		}
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, http.StatusRequestEntityTooLarge, "body_too_large", fmt.Sprintf("request body must be at most %d bytes", maxBytes))
+			return false
+		}
+		writeError(w, http.StatusBadRequest, "invalid_body", "Invalid body: "+err.Error())
+		return false
+	}
+	return true
+}
+
+// --- DATABASE HELPERS ---
+
+// QueryTimeout bounds the database work done while serving a single request
+const QueryTimeout = 5 * time.Second
+
+// queryContext derives the context for a request's database calls. It is cancelled
+// when the client disconnects or QueryTimeout elapses, whichever comes first.
+func queryContext(r *http.Request) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(r.Context(), QueryTimeout)
+}
+
+// dbError reports a failed database call. Cancelled or timed-out queries get 504;
+// anything else gets the given status and message.
+func dbError(w http.ResponseWriter, err error, status int, code, msg string) {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		writeError(w, http.StatusGatewayTimeout, "database_timeout", "Database timeout")
+		return
+	}
+	writeError(w, status, code, msg)
+}
+
+// errNoRowsAffected means a single-row UPDATE did not change exactly one row
+var errNoRowsAffected = errors.New("no rows affected")
+
+// execOne runs a single-row UPDATE in tx and fails unless it changed exactly one row
+func execOne(ctx context.Context, tx *sql.Tx, query string, args ...interface{}) error {
+	res, err := tx.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected != 1 {
+		return fmt.Errorf("%w: %d", errNoRowsAffected, affected)
+	}
+	return nil
+}
+
+// --- FRAUD CHECKS ---
+
+// FraudChecker decides whether a transfer may go ahead. Check returns false to
+// block the transfer, or an error if no decision could be made.
+type FraudChecker interface {
+	Check(ctx context.Context, from, to int, amount int64) (bool, error)
+}
+
+// NoopFraudChecker allows every transfer
+type NoopFraudChecker struct{}
+
+func (NoopFraudChecker) Check(ctx context.Context, from, to int, amount int64) (bool, error) {
+	return true, nil
+}
+
+// fraudChecker is consulted by TransferHandler and BulkTransfer. Replace it before
+// serving to plug in a real compliance service (e.g. a gRPC client).
+var fraudChecker FraudChecker = NoopFraudChecker{}
+
+// --- MIDDLEWARE ---
+
+// AuthMiddleware simulates checking an API Key and adding the user ID to the context
+func AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		apiKey := r.Header.Get("X-API-Key")
+		if apiKey == "" {
+			writeError(w, http.StatusUnauthorized, "missing_api_key", "Missing API Key")
+			return
+		}
+
+		ctx, cancel := queryContext(r)
+		defer cancel()
+
+		var userID int
+		var role string
+		// Look up by digest. The comparison happens on SHA-256 output, so lookup
+		// timing reveals nothing useful about the presented key.
+		err := db.QueryRowContext(ctx, "SELECT id, role FROM users WHERE api_key_hash = ?", hashAPIKey(apiKey)).Scan(&userID, &role)
+		if err != nil {
+			dbError(w, err, http.StatusUnauthorized, "invalid_api_key", "Invalid API Key")
+			return
+		}
+
+		// Add user ID and role to context
+		ctx = context.WithValue(r.Context(), "user_id", userID)
+		ctx = context.WithValue(ctx, "role", role)
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// keyLimiter is one API key's token bucket and when it was last used
+type keyLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen atomic.Int64 // Unix nanoseconds
 }
 
-type Transaction struct {
-	ID        int    `json:"id"`
-	FromUser  int    `json:"from_user"`
-	ToUser    int    `json:"to_user"`
-	Amount    int64  `json:"amount"`
-	Timestamp string `json:"timestamp"`
-	Status    string `json:"status"` // 'COMPLETED', 'REFUNDED'
-}
+// maxLimiters is how many buckets are kept before idle ones are evicted
+const maxLimiters = 10000
+
+// limiters maps hashAPIKey(key) to its *keyLimiter. Storing the digest keeps raw
+// keys out of memory; limiterCount tracks the size, which sync.Map doesn't.
+var (
+	limiters     sync.Map
+	limiterCount atomic.Int64
+)
+
+// limiterFor returns the token bucket for an API key digest, creating it on first use
+func limiterFor(keyHash string, now time.Time) *rate.Limiter {
+	// A bucket idle long enough to refill is the same as a new one, so drop
+	// those once the map grows instead of keeping every key ever presented.
+	if limiterCount.Load() > maxLimiters {
+		full := time.Duration(float64(RateBurst) / float64(RateLimit) * float64(time.Second))
+		limiters.Range(func(k, v interface{}) bool {
+			if now.Sub(time.Unix(0, v.(*keyLimiter).lastSeen.Load())) > full {
+				if _, deleted := limiters.LoadAndDelete(k); deleted {
+					limiterCount.Add(-1)
+				}
+			}
+			return true
+		})
+	}
+
+	v, ok := limiters.Load(keyHash)
+	if !ok {
+		var loaded bool
+		v, loaded = limiters.LoadOrStore(keyHash, &keyLimiter{limiter: rate.NewLimiter(RateLimit, RateBurst)})
+		if !loaded {
+			limiterCount.Add(1)
+		}
+	}
+	l := v.(*keyLimiter)
+	l.lastSeen.Store(now.UnixNano())
+	return l.limiter
+}
+
+// RateLimitMiddleware throttles requests per presented API key. It runs before
+// AuthMiddleware, so invalid or missing keys are throttled too and a flood of
+// them never reaches the database.
+func RateLimitMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		keyHash := hashAPIKey(r.Header.Get("X-API-Key"))
+		reservation := limiterFor(keyHash, time.Now()).Reserve()
+		if delay := reservation.Delay(); delay > 0 {
+			reservation.Cancel()
+			w.Header().Set("Retry-After", strconv.Itoa(int(delay.Seconds())+1))
+			writeError(w, http.StatusTooManyRequests, "rate_limited", "Rate limit exceeded")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// Authenticated chains RateLimitMiddleware and AuthMiddleware; every API route uses it
+func Authenticated(next http.HandlerFunc) http.HandlerFunc {
+	return RateLimitMiddleware(AuthMiddleware(next))
+}
+
+// CORSMiddleware lets browser clients on allowlisted origins call the API.
+// It answers OPTIONS preflights itself and rejects cross-origin requests from
+// any other origin. Requests without an Origin header (non-browser clients) pass through.
+func CORSMiddleware(allowedOrigins []string, next http.HandlerFunc) http.HandlerFunc {
+	allowed := make(map[string]bool, len(allowedOrigins))
+	for _, o := range allowedOrigins {
+		allowed[o] = true
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+		if !allowed[origin] {
+			writeError(w, http.StatusForbidden, "origin_not_allowed", "Origin not allowed")
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Expose-Headers", "Retry-After")
+		if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-API-Key, Idempotency-Key")
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// HSTSMiddleware tells browsers to use HTTPS for all future requests. Only install it when serving TLS.
+func HSTSMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Strict-Transport-Security", "max-age=31536000; includeSubDomains")
+		next(w, r)
+	}
+}
+
+// AdminMiddleware rejects callers without the admin role.
+// It must be wrapped by AuthMiddleware, which puts the role in the context.
+func AdminMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isAdmin(r) {
+			writeError(w, http.StatusForbidden, "admin_required", "Admin access required")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// isAdmin reports whether the authenticated caller has the admin role
+func isAdmin(r *http.Request) bool {
+	role, _ := r.Context().Value("role").(string)
+	return role == RoleAdmin
+}
+
+// --- METRICS ---
+
+var (
+	transfersTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ledger_transfers_total",
+		Help: "Transfer requests by outcome (success, rejected, error).",
+	}, []string{"status"})
+
+	refundsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ledger_refunds_total",
+		Help: "Refund requests by outcome (success, rejected, error).",
+	}, []string{"status"})
+
+	bulkTransfersTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ledger_bulk_transfers_total",
+		Help: "Bulk transfer requests by outcome (success, rejected, error).",
+	}, []string{"status"})
+
+	holdCapturesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ledger_hold_captures_total",
+		Help: "Hold capture requests by outcome (success, rejected, error).",
+	}, []string{"status"})
+
+	transferDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "ledger_transfer_duration_seconds",
+		Help:    "Latency of TransferHandler, including the fraud check.",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	moneySupply = &moneySupplyCollector{GaugeVec: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ledger_money_supply",
+		Help: "Sum of all user balances by currency, in minor units.",
+	}, []string{"currency"})}
+)
+
+func init() {
+	prometheus.MustRegister(transfersTotal, refundsTotal, bulkTransfersTotal, holdCapturesTotal, transferDuration, moneySupply)
+}
+
+// moneySupplyCollector refreshes the per-currency balance totals on every scrape.
+// Amounts in different currencies are never summed together.
+type moneySupplyCollector struct {
+	*prometheus.GaugeVec
+	mu sync.Mutex // Serializes scrapes so one never sees another's half-refreshed vector
+}
+
+func (c *moneySupplyCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// A failed query drops the series rather than reporting a made-up total
+	c.Reset()
+	totals, err := balancesByCurrency()
+	if err != nil {
+		log.Printf("Metrics: summing balances: %v", err)
+		return
+	}
+	for currency, total := range totals {
+		c.WithLabelValues(currency).Set(float64(total))
+	}
+	c.GaugeVec.Collect(ch)
+}
+
+// balancesByCurrency sums user balances per currency
+func balancesByCurrency() (map[string]int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), QueryTimeout)
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, "SELECT currency, SUM(balance) FROM users GROUP BY currency")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	totals := make(map[string]int64)
+	for rows.Next() {
+		var currency string
+		var total int64
+		if err := rows.Scan(&currency, &total); err != nil {
+			return nil, err
+		}
+		totals[currency] = total
+	}
+	return totals, rows.Err()
+}
+
+// statusRecorder remembers the status code a handler wrote
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(code int) {
+	sr.status = code
+	sr.ResponseWriter.WriteHeader(code)
+}
+
+// MetricsMiddleware counts each request by outcome and, if latency is non-nil, records its duration.
+// It must be wrapped by Authenticated, so auth failures and throttled requests aren't counted.
+func MetricsMiddleware(outcomes *prometheus.CounterVec, latency prometheus.Observer, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(rec, r)
+
+		if latency != nil {
+			latency.Observe(time.Since(start).Seconds())
+		}
+		outcome := "success"
+		switch {
+		case rec.status >= 500:
+			outcome = "error"
+		case rec.status >= 400:
+			outcome = "rejected"
+		}
+		outcomes.WithLabelValues(outcome).Inc()
+	}
+}
+
+// --- HANDLERS ---
+
+// HealthHandler is an unauthenticated liveness/readiness probe for load balancers
+func HealthHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+
+	resp := map[string]interface{}{
+		"status":         "ok",
+		"uptime_seconds": int64(time.Since(startTime).Seconds()),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := db.PingContext(ctx); err != nil {
+		resp["status"] = "unavailable"
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// CreateUser opens a new account and returns its API Key.
+// Only the key's hash is stored, so the plaintext is shown in this response alone.
+func CreateUser(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed")
+		return
+	}
+
+	type CreateUserReq struct {
+		Username       string `json:"username"`
+		InitialBalance int64  `json:"initial_balance"`
+	}
+	var req CreateUserReq
+	if !decodeJSONBody(w, r, &req, MaxBodyBytes) {
+		return
+	}
+
+	req.Username = strings.TrimSpace(req.Username)
+	if req.Username == "" {
+		writeError(w, http.StatusBadRequest, "username_required", "username required")
+		return
+	}
+	if req.InitialBalance < 0 {
+		writeError(w, http.StatusBadRequest, "invalid_initial_balance", "initial_balance cannot be negative")
+		return
+	}
+
+	apiKey, err := generateAPIKey()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "key_generation_failed", "Could not generate API Key")
+		return
+	}
+
+	ctx, cancel := queryContext(r)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+	defer tx.Rollback() // No-op once committed
+
+	var taken bool
+	if err := tx.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM users WHERE username = ?)", req.Username).Scan(&taken); err != nil {
+		dbError(w, err, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+	if taken {
+		writeError(w, http.StatusConflict, "username_taken", "username already exists")
+		return
+	}
+
+	// The initial balance is an external credit, recorded as the opening balance for reconciliation
+	res, err := tx.ExecContext(ctx, "INSERT INTO users (username, balance, opening_balance, api_key_hash, currency) VALUES (?, ?, ?, ?, ?)",
+		req.Username, req.InitialBalance, req.InitialBalance, hashAPIKey(apiKey), DefaultCurrency)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		dbError(w, err, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":       id,
+		"username": req.Username,
+		"api_key":  apiKey,
+	})
+}
+
+// UserView is the admin-facing view of an account. It has no API Key field at all,
+// so a key can never be serialized into it.
+type UserView struct {
+	ID       int    `json:"id"`
+	Username string `json:"username"`
+	Balance  Money  `json:"balance"`
+	Currency string `json:"currency"`
+	Frozen   bool   `json:"frozen"`
+	Role     string `json:"role"`
+}
+
+// GetUser lets admins inspect any account during support
+func GetUser(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_user_id", "Invalid user id")
+		return
+	}
+
+	ctx, cancel := queryContext(r)
+	defer cancel()
+
+	var u UserView
+	err = db.QueryRowContext(ctx, "SELECT id, username, balance, currency, frozen, role FROM users WHERE id = ?", id).
+		Scan(&u.ID, &u.Username, &u.Balance, &u.Currency, &u.Frozen, &u.Role)
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, "user_not_found", "User not found")
+		return
+	}
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+	u.Balance.Currency = u.Currency
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(u)
+}
+
+// RotateAPIKey replaces the caller's API Key with a fresh one.
+// The old key stops working immediately; the new key is only shown in this response.
+func RotateAPIKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed")
+		return
+	}
+	userID := r.Context().Value("user_id").(int)
+
+	apiKey, err := generateAPIKey()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "key_generation_failed", "Could not generate API Key")
+		return
+	}
+
+	ctx, cancel := queryContext(r)
+	defer cancel()
+
+	if _, err := db.ExecContext(ctx, "UPDATE users SET api_key_hash = ? WHERE id = ?", hashAPIKey(apiKey), userID); err != nil {
+		dbError(w, err, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"api_key": apiKey})
+}
+
+// generateAPIKey returns a new random API Key from crypto/rand
+func generateAPIKey() (string, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return "secret_" + hex.EncodeToString(buf), nil
+}
+
+// GetBalance returns the authenticated user's balance
+func GetBalance(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(int)
+
+	ctx, cancel := queryContext(r)
+	defer cancel()
+
+	var balance, held Money
+	err := db.QueryRowContext(ctx, "SELECT balance, held, currency FROM users WHERE id = ?", userID).Scan(&balance, &held, &balance.Currency)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+	held.Currency = balance.Currency
+	available, err := balance.Sub(held)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"user_id":   userID,
+		"balance":   balance,
+		"held":      held,
+		"available": available, // balance - held
+		"currency":  balance.Currency,
+		"formatted": balance.String(),
+	})
+}
+
+// TransferHandler processes peer-to-peer payments
+// Intention: Users send money to others.
+// With ?dry_run=true the transfer is only validated and the predicted outcome is returned.
+func TransferHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed")
+		return
+	}
+
+	userID := r.Context().Value("user_id").(int)
+
+	dryRun := false
+	if v := r.URL.Query().Get("dry_run"); v != "" {
+		var err error
+		if dryRun, err = strconv.ParseBool(v); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_dry_run", "Invalid dry_run value")
+			return
+		}
+	}
+
+	var req transferBody
+	if !decodeJSONBody(w, r, &req, MaxBodyBytes) {
+		return
+	}
+
+	if code, msg := transferInputError(userID, req.ToUser, req.Amount, req.Memo); code != "" {
+		writeError(w, http.StatusBadRequest, code, msg)
+		return
+	}
+
+	ctx, cancel := queryContext(r)
+	defer cancel()
+
+	// Retried requests carrying the same Idempotency-Key get the original response
+	// instead of executing a second transfer.
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+	var requestHash string
+	if idempotencyKey != "" && !dryRun {
+		canonical, _ := json.Marshal(req)
+		sum := sha256.Sum256(canonical)
+		requestHash = hex.EncodeToString(sum[:])
+
+		stored, err := lookupIdempotentResponse(ctx, userID, idempotencyKey, requestHash)
+		if errors.Is(err, errIdempotencyMismatch) {
+			writeError(w, http.StatusBadRequest, "idempotency_key_reused", "Idempotency-Key reused with a different request body")
+			return
+		}
+		if err != nil {
+			dbError(w, err, http.StatusInternalServerError, "database_error", "Database error")
+			return
+		}
+		if stored != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(stored)
+			return
+		}
+	}
+
+	// A conflicting concurrent update to either account makes an attempt roll back
+	// and start over with fresh reads.
+	for attempt := 1; attempt <= MaxVersionRetries; attempt++ {
+		if !attemptTransfer(ctx, w, userID, req, dryRun, idempotencyKey, requestHash) {
+			return
+		}
+	}
+	writeError(w, http.StatusConflict, "version_conflict", "account was updated concurrently, please retry")
+}
+
+// transferBody is the JSON body of a transfer request
+type transferBody struct {
+	ToUser int    `json:"to_user"`
+	Amount int64  `json:"amount"`
+	Memo   string `json:"memo,omitempty"`
+}
+
+// attemptTransfer runs one transactional attempt at a transfer and writes the response.
+// It returns true, having written nothing, if the sender's row changed version since it
+// was read, so the caller should retry.
+func attemptTransfer(ctx context.Context, w http.ResponseWriter, userID int, req transferBody, dryRun bool, idempotencyKey, requestHash string) (retry bool) {
+	// All reads and writes share one transaction so a failure part-way through
+	// can never debit the sender without crediting the recipient.
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError, "transfer_failed", "Transfer failed")
+		return false
+	}
+	defer tx.Rollback() // No-op once committed
+
+	// 1. Sender, recipient, and limit checks
+	check, err := checkTransfer(ctx, tx, userID, req.ToUser, req.Amount)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError, "database_error", "Database error")
+		return false
+	}
+
+	if check.Reason != "" {
+		// A dry run reports the first failing check instead of returning an error
+		if dryRun {
+			writeDryRun(w, check.Reason, check.Balance)
+			return false
+		}
+		writeError(w, check.Status, check.Code, check.Reason)
+		return false
+	}
+
+	if !dryRun {
+		// Fraud Detection / Compliance Check
+		allowed, err := fraudChecker.Check(ctx, userID, req.ToUser, req.Amount)
+		if err != nil {
+			log.Printf("Fraud check for transfer %d -> %d: %v", userID, req.ToUser, err)
+			dbError(w, err, http.StatusServiceUnavailable, "fraud_check_unavailable", "fraud check unavailable")
+			return false
+		}
+		if !allowed {
+			writeError(w, http.StatusForbidden, "fraud_check_blocked", "transfer blocked by fraud check")
+			return false
+		}
+	}
+
+	// The fee is debited with the amount and credited to the fee collector
+	fee := Fees.Fee(req.Amount)
+	debit := req.Amount + fee
+	if fee > 0 {
+		if err := checkFeeCollector(ctx, tx, check.Currency); errors.Is(err, errFeeCurrency) {
+			writeError(w, http.StatusUnprocessableEntity, "fee_currency_mismatch", "fees cannot be collected in this currency")
+			return false
+		} else if err != nil {
+			dbError(w, err, http.StatusInternalServerError, "transfer_failed", "Transfer failed")
+			return false
+		}
+	}
+
+	// 2. Perform Transfer (Update Sender)
+	// Checking and debiting is one conditional UPDATE. Funds reserved by holds are not
+	// available to spend. The version condition catches any write to the sender since
+	// checkTransfer read it; that attempt is retried rather than judged on stale reads.
+	res, err := tx.ExecContext(ctx, "UPDATE users SET balance = balance - ?, version = version + 1 WHERE id = ? AND version = ? AND balance - held >= ?",
+		debit, userID, check.Version, debit)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError, "transfer_failed", "Transfer failed")
+		return false
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError, "transfer_failed", "Transfer failed")
+		return false
+	}
+	if affected == 0 {
+		var version int64
+		if err := tx.QueryRowContext(ctx, "SELECT version FROM users WHERE id = ?", userID).Scan(&version); err != nil {
+			dbError(w, err, http.StatusInternalServerError, "transfer_failed", "Transfer failed")
+			return false
+		}
+		if version != check.Version {
+			return true
+		}
+		if dryRun {
+			writeDryRun(w, "Insufficient funds", check.Balance)
+			return false
+		}
+		writeError(w, http.StatusBadRequest, "insufficient_funds", "Insufficient funds")
+		return false
+	}
+
+	// A dry run stops here: report the post-debit balance, and the deferred
+	// Rollback discards the debit.
+	if dryRun {
+		writeDryRun(w, "", check.Balance-debit)
+		return false
+	}
+
+	// 3. Update Recipient
+	// Like the debit, the credit only applies to the row checkTransfer read
+	res, err = tx.ExecContext(ctx, "UPDATE users SET balance = balance + ?, version = version + 1 WHERE id = ? AND version = ?",
+		req.Amount, req.ToUser, check.RecipientVersion)
+	if err != nil {
+		log.Printf("Failed to credit user %d: %v", req.ToUser, err)
+		dbError(w, err, http.StatusInternalServerError, "transfer_failed", "Transfer failed")
+		return false
+	}
+	if affected, err := res.RowsAffected(); err != nil {
+		dbError(w, err, http.StatusInternalServerError, "transfer_failed", "Transfer failed")
+		return false
+	} else if affected == 0 {
+		return true
+	}
+
+	// 4. Log Transaction
+	res, err = tx.ExecContext(ctx, "INSERT INTO transactions (from_user, to_user, amount, currency, timestamp, status, memo) VALUES (?, ?, ?, ?, ?, 'COMPLETED', ?)",
+		userID, req.ToUser, req.Amount, check.Currency, time.Now().UTC().Format(time.RFC3339), nullableMemo(req.Memo))
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError, "transfer_failed", "Transfer failed")
+		return false
+	}
+	txnID, err := res.LastInsertId()
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError, "transfer_failed", "Transfer failed")
+		return false
+	}
+
+	if fee > 0 {
+		if err := collectFee(ctx, tx, userID, fee, check.Currency, txnID); err != nil {
+			dbError(w, err, http.StatusInternalServerError, "transfer_failed", "Transfer failed")
+			return false
+		}
+	}
+
+	resp, _ := json.Marshal(map[string]interface{}{"status": "success", "fee": fee})
+
+	// 5. Remember the Idempotency-Key with the transfer, so a concurrent retry
+	// with the same key fails on the primary key instead of paying twice.
+	if idempotencyKey != "" {
+		_, err = tx.ExecContext(ctx, "INSERT INTO idempotency_keys (key, user_id, request_hash, response_body, created_at) VALUES (?, ?, ?, ?, ?)",
+			idempotencyKey, userID, requestHash, string(resp), time.Now().UTC().Format(time.RFC3339))
+		if err != nil {
+			dbError(w, err, http.StatusInternalServerError, "transfer_failed", "Transfer failed")
+			return false
+		}
+	}
+
+	// 6. Queue the recipient's webhook in the same transaction, so every committed
+	// transfer gets its notification even if the process restarts.
+	err = enqueueWebhook(ctx, tx, TransferEvent{
+		Type:          "transfer.completed",
+		TransactionID: txnID,
+		Amount:        Money{Amount: req.Amount, Currency: check.Currency},
+		FromUser:      userID,
+		ToUser:        req.ToUser,
+	})
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError, "transfer_failed", "Transfer failed")
+		return false
+	}
+
+	if err := tx.Commit(); err != nil {
+		dbError(w, err, http.StatusInternalServerError, "transfer_failed", "Transfer failed")
+		return false
+	}
+	wakeWebhookWorker()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(resp)
+	return false
+}
+
+// HoldFunds authorizes a payment without moving money yet. The amount is reserved in
+// the sender's held funds and recorded as a PENDING transaction, to be completed with
+// CaptureHold or cancelled with ReleaseHold.
+func HoldFunds(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed")
+		return
+	}
+	userID := r.Context().Value("user_id").(int)
+
+	type HoldReq struct {
+		ToUser int    `json:"to_user"`
+		Amount int64  `json:"amount"`
+		Memo   string `json:"memo,omitempty"`
+	}
+	var req HoldReq
+	if !decodeJSONBody(w, r, &req, MaxBodyBytes) {
+		return
+	}
+	if code, msg := transferInputError(userID, req.ToUser, req.Amount, req.Memo); code != "" {
+		writeError(w, http.StatusBadRequest, code, msg)
+		return
+	}
+
+	ctx, cancel := queryContext(r)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError, "hold_failed", "Hold failed")
+		return
+	}
+	defer tx.Rollback() // No-op once committed
+
+	check, err := checkTransfer(ctx, tx, userID, req.ToUser, req.Amount)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+	if check.Reason != "" {
+		writeError(w, check.Status, check.Code, check.Reason)
+		return
+	}
+
+	// Reserve against available funds (balance minus existing holds)
+	res, err := tx.ExecContext(ctx, "UPDATE users SET held = held + ?, version = version + 1 WHERE id = ? AND balance - held >= ?", req.Amount, userID, req.Amount)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError, "hold_failed", "Hold failed")
+		return
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError, "hold_failed", "Hold failed")
+		return
+	}
+	if affected == 0 {
+		writeError(w, http.StatusBadRequest, "insufficient_funds", "Insufficient funds")
+		return
+	}
+
+	res, err = tx.ExecContext(ctx, "INSERT INTO transactions (from_user, to_user, amount, currency, timestamp, status, memo) VALUES (?, ?, ?, ?, ?, 'PENDING', ?)",
+		userID, req.ToUser, req.Amount, check.Currency, time.Now().UTC().Format(time.RFC3339), nullableMemo(req.Memo))
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError, "hold_failed", "Hold failed")
+		return
+	}
+	txnID, err := res.LastInsertId()
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError, "hold_failed", "Hold failed")
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		dbError(w, err, http.StatusInternalServerError, "hold_failed", "Hold failed")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "held", "transaction_id": txnID})
+}
+
+// CaptureHold completes a PENDING hold, moving the reserved money to the recipient
+func CaptureHold(w http.ResponseWriter, r *http.Request) {
+	settleHold(w, r, true)
+}
+
+// ReleaseHold cancels a PENDING hold and returns the reserved amount to available funds
+func ReleaseHold(w http.ResponseWriter, r *http.Request) {
+	settleHold(w, r, false)
+}
+
+func settleHold(w http.ResponseWriter, r *http.Request, capture bool) {
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed")
+		return
+	}
+	userID := r.Context().Value("user_id").(int)
+
+	type SettleReq struct {
+		TransactionID int `json:"transaction_id"`
+	}
+	var req SettleReq
+	if !decodeJSONBody(w, r, &req, MaxBodyBytes) {
+		return
+	}
+
+	ctx, cancel := queryContext(r)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+	defer tx.Rollback() // No-op once committed
+
+	var fromUser, toUser int
+	var amount int64
+	var currency, status string
+	err = tx.QueryRowContext(ctx, "SELECT from_user, to_user, amount, currency, status FROM transactions WHERE id = ?", req.TransactionID).Scan(&fromUser, &toUser, &amount, &currency, &status)
+	if err != nil {
+		dbError(w, err, http.StatusNotFound, "transaction_not_found", "Transaction not found")
+		return
+	}
+
+	// Only the payer (or an admin) may settle their hold
+	if fromUser != userID && !isAdmin(r) {
+		writeError(w, http.StatusForbidden, "forbidden", "Unauthorized")
+		return
+	}
+	if status != "PENDING" {
+		writeError(w, http.StatusConflict, "transaction_not_pending", "transaction is not pending")
+		return
+	}
+
+	newStatus := "RELEASED"
+	var fee int64
+	if capture {
+		newStatus = "COMPLETED"
+
+		var frozen bool
+		var recipientBalance int64
+		if err := tx.QueryRowContext(ctx, "SELECT frozen FROM users WHERE id = ?", fromUser).Scan(&frozen); err != nil {
+			dbError(w, err, http.StatusInternalServerError, "database_error", "Database error")
+			return
+		}
+		if frozen {
+			writeError(w, http.StatusLocked, "account_frozen", "account frozen")
+			return
+		}
+		if err := tx.QueryRowContext(ctx, "SELECT balance FROM users WHERE id = ?", toUser).Scan(&recipientBalance); err != nil {
+			dbError(w, err, http.StatusInternalServerError, "database_error", "Database error")
+			return
+		}
+		if _, ok := checkedAdd(recipientBalance, amount); !ok {
+			writeError(w, http.StatusUnprocessableEntity, "recipient_balance_overflow", "recipient balance would overflow")
+			return
+		}
+
+		// The fee is charged at capture, since that is when money moves
+		fee = Fees.Fee(amount)
+		if fee > 0 {
+			if err := checkFeeCollector(ctx, tx, currency); errors.Is(err, errFeeCurrency) {
+				writeError(w, http.StatusUnprocessableEntity, "fee_currency_mismatch", "fees cannot be collected in this currency")
+				return
+			} else if err != nil {
+				dbError(w, err, http.StatusInternalServerError, "capture_failed", "Capture failed")
+				return
+			}
+		}
+
+		// Spend the reserved funds: balance and held drop together. The fee was not
+		// reserved, so it must come out of the sender's available funds.
+		err := execOne(ctx, tx, "UPDATE users SET balance = balance - ?, held = held - ?, version = version + 1 WHERE id = ? AND balance - held >= ?",
+			amount+fee, amount, fromUser, fee)
+		if errors.Is(err, errNoRowsAffected) {
+			writeError(w, http.StatusBadRequest, "insufficient_funds", "Insufficient funds to cover the fee")
+			return
+		} else if err != nil {
+			dbError(w, err, http.StatusInternalServerError, "capture_failed", "Capture failed")
+			return
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE users SET balance = balance + ?, version = version + 1 WHERE id = ?", amount, toUser); err != nil {
+			dbError(w, err, http.StatusInternalServerError, "capture_failed", "Capture failed")
+			return
+		}
+	} else {
+		if _, err := tx.ExecContext(ctx, "UPDATE users SET held = held - ?, version = version + 1 WHERE id = ?", amount, fromUser); err != nil {
+			dbError(w, err, http.StatusInternalServerError, "release_failed", "Release failed")
+			return
+		}
+	}
+
+	// The timestamp moves to settlement time, so refund windows start at capture
+	_, err = tx.ExecContext(ctx, "UPDATE transactions SET status = ?, timestamp = ? WHERE id = ?",
+		newStatus, time.Now().UTC().Format(time.RFC3339), req.TransactionID)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+
+	if fee > 0 {
+		if err := collectFee(ctx, tx, fromUser, fee, currency, int64(req.TransactionID)); err != nil {
+			dbError(w, err, http.StatusInternalServerError, "capture_failed", "Capture failed")
+			return
+		}
+	}
+
+	if capture {
+		err = enqueueWebhook(ctx, tx, TransferEvent{
+			Type:          "transfer.completed",
+			TransactionID: int64(req.TransactionID),
+			Amount:        Money{Amount: amount, Currency: currency},
+			FromUser:      fromUser,
+			ToUser:        toUser,
+		})
+		if err != nil {
+			dbError(w, err, http.StatusInternalServerError, "capture_failed", "Capture failed")
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		dbError(w, err, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+	wakeWebhookWorker()
+
+	w.Header().Set("Content-Type", "application/json")
+	resp := map[string]interface{}{"status": strings.ToLower(newStatus), "transaction_id": req.TransactionID}
+	if capture {
+		resp["fee"] = fee
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// BulkTransfer pays many recipients in one all-or-nothing transaction.
+// If any item fails, nothing is committed and the per-item results say why.
+func BulkTransfer(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed")
+		return
+	}
+	userID := r.Context().Value("user_id").(int)
+
+	type BulkItem struct {
+		ToUser int    `json:"to_user"`
+		Amount int64  `json:"amount"`
+		Memo   string `json:"memo,omitempty"`
+	}
+	type BulkReq struct {
+		Transfers []BulkItem `json:"transfers"`
+	}
+	type BulkResult struct {
+		Index         int    `json:"index"`
+		ToUser        int    `json:"to_user"`
+		Amount        int64  `json:"amount"`
+		Status        string `json:"status"` // 'ok', 'failed', or 'rolled_back' when another item failed
+		Code          string `json:"code,omitempty"`
+		Reason        string `json:"reason,omitempty"`
+		TransactionID int64  `json:"transaction_id,omitempty"`
+		Fee           int64  `json:"fee,omitempty"`
+	}
+
+	var req BulkReq
+	if !decodeJSONBody(w, r, &req, MaxBulkBodyBytes) {
+		return
+	}
+	if len(req.Transfers) == 0 {
+		writeError(w, http.StatusBadRequest, "empty_batch", "transfers must not be empty")
+		return
+	}
+	if len(req.Transfers) > MaxBulkTransferItems {
+		writeError(w, http.StatusRequestEntityTooLarge, "too_many_transfers", fmt.Sprintf("at most %d transfers per request", MaxBulkTransferItems))
+		return
+	}
+
+	// Non-positive amounts are reported per item below. Each item pays its own fee.
+	var total int64
+	for _, item := range req.Transfers {
+		if item.Amount <= 0 || item.Amount > MaxTransferAmount {
+			continue
+		}
+		var ok bool
+		if total, ok = checkedAdd(total, item.Amount+Fees.Fee(item.Amount)); !ok {
+			writeError(w, http.StatusBadRequest, "amount_too_large", "Amount exceeds maximum transfer")
+			return
+		}
+	}
+
+	ctx, cancel := queryContext(r)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError, "transfer_failed", "Transfer failed")
+		return
+	}
+	defer tx.Rollback() // No-op once committed
+
+	// Reject the whole batch up front if the sender can't cover it
+	var available int64
+	if err := tx.QueryRowContext(ctx, "SELECT balance - held FROM users WHERE id = ?", userID).Scan(&available); err != nil {
+		dbError(w, err, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+	if total > available {
+		writeError(w, http.StatusBadRequest, "insufficient_funds", "Insufficient funds")
+		return
+	}
+
+	results := make([]BulkResult, len(req.Transfers))
+	failed := false
+	now := time.Now().UTC().Format(time.RFC3339)
+	for i, item := range req.Transfers {
+		res := &results[i]
+		*res = BulkResult{Index: i, ToUser: item.ToUser, Amount: item.Amount, Status: "failed"}
+
+		if code, msg := transferInputError(userID, item.ToUser, item.Amount, item.Memo); code != "" {
+			res.Code, res.Reason, failed = code, msg, true
+			continue
+		}
+		// Checks see the earlier items of this batch, so the daily limit covers the batch as a whole
+		check, err := checkTransfer(ctx, tx, userID, item.ToUser, item.Amount)
+		if err != nil {
+			dbError(w, err, http.StatusInternalServerError, "database_error", "Database error")
+			return
+		}
+		if check.Reason != "" {
+			res.Code, res.Reason, failed = check.Code, check.Reason, true
+			continue
+		}
+		allowed, err := fraudChecker.Check(ctx, userID, item.ToUser, item.Amount)
+		if err != nil {
+			log.Printf("Fraud check for transfer %d -> %d: %v", userID, item.ToUser, err)
+			dbError(w, err, http.StatusServiceUnavailable, "fraud_check_unavailable", "fraud check unavailable")
+			return
+		}
+		if !allowed {
+			res.Code, res.Reason, failed = "fraud_check_blocked", "transfer blocked by fraud check", true
+			continue
+		}
+
+		fee := Fees.Fee(item.Amount)
+		if fee > 0 {
+			if err := checkFeeCollector(ctx, tx, check.Currency); errors.Is(err, errFeeCurrency) {
+				res.Code, res.Reason, failed = "fee_currency_mismatch", "fees cannot be collected in this currency", true
+				continue
+			} else if err != nil {
+				dbError(w, err, http.StatusInternalServerError, "transfer_failed", "Transfer failed")
+				return
+			}
+		}
+
+		debit, err := tx.ExecContext(ctx, "UPDATE users SET balance = balance - ?, version = version + 1 WHERE id = ? AND balance - held >= ?", item.Amount+fee, userID, item.Amount+fee)
+		if err != nil {
+			dbError(w, err, http.StatusInternalServerError, "transfer_failed", "Transfer failed")
+			return
+		}
+		if affected, err := debit.RowsAffected(); err != nil {
+			dbError(w, err, http.StatusInternalServerError, "transfer_failed", "Transfer failed")
+			return
+		} else if affected == 0 {
+			res.Code, res.Reason, failed = "insufficient_funds", "Insufficient funds", true
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE users SET balance = balance + ?, version = version + 1 WHERE id = ?", item.Amount, item.ToUser); err != nil {
+			dbError(w, err, http.StatusInternalServerError, "transfer_failed", "Transfer failed")
+			return
+		}
+		ins, err := tx.ExecContext(ctx, "INSERT INTO transactions (from_user, to_user, amount, currency, timestamp, status, memo) VALUES (?, ?, ?, ?, ?, 'COMPLETED', ?)",
+			userID, item.ToUser, item.Amount, check.Currency, now, nullableMemo(item.Memo))
+		if err != nil {
+			dbError(w, err, http.StatusInternalServerError, "transfer_failed", "Transfer failed")
+			return
+		}
+		if res.TransactionID, err = ins.LastInsertId(); err != nil {
+			dbError(w, err, http.StatusInternalServerError, "transfer_failed", "Transfer failed")
+			return
+		}
+		if fee > 0 {
+			if err := collectFee(ctx, tx, userID, fee, check.Currency, res.TransactionID); err != nil {
+				dbError(w, err, http.StatusInternalServerError, "transfer_failed", "Transfer failed")
+				return
+			}
+			res.Fee = fee
+		}
+		err = enqueueWebhook(ctx, tx, TransferEvent{
+			Type:          "transfer.completed",
+			TransactionID: res.TransactionID,
+			Amount:        Money{Amount: item.Amount, Currency: check.Currency},
+			FromUser:      userID,
+			ToUser:        item.ToUser,
+		})
+		if err != nil {
+			dbError(w, err, http.StatusInternalServerError, "transfer_failed", "Transfer failed")
+			return
+		}
+		res.Status = "ok"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if failed {
+		// The deferred Rollback undoes the items that went through
+		for i := range results {
+			if results[i].Status == "ok" {
+				results[i].Status, results[i].TransactionID, results[i].Fee = "rolled_back", 0, 0
+			}
+		}
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(map[string]interface{}{"status": "failed", "results": results})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		dbError(w, err, http.StatusInternalServerError, "transfer_failed", "Transfer failed")
+		return
+	}
+	wakeWebhookWorker()
+
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "success", "results": results})
+}
+
+// errIdempotencyMismatch means an Idempotency-Key was reused for a different request
+var errIdempotencyMismatch = errors.New("idempotency key reused with different request")
+
+// lookupIdempotentResponse returns the stored response for a key this user already used,
+// or nil if the key is new. Expired keys are purged first so they can be reused.
+func lookupIdempotentResponse(ctx context.Context, userID int, key, requestHash string) ([]byte, error) {
+	cutoff := time.Now().UTC().Add(-IdempotencyTTL).Format(time.RFC3339)
+	if _, err := db.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE created_at < ?", cutoff); err != nil {
+		return nil, err
+	}
+
+	var storedHash, body string
+	err := db.QueryRowContext(ctx, "SELECT request_hash, response_body FROM idempotency_keys WHERE key = ? AND user_id = ?", key, userID).Scan(&storedHash, &body)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if storedHash != requestHash {
+		return nil, errIdempotencyMismatch
+	}
+	return []byte(body), nil
+}
+
+// transferInputError checks the request-level rules shared by transfers and holds.
+// It returns an error message, or "" if the input is acceptable.
+func transferInputError(userID, toUser int, amount int64, memo string) (code, msg string) {
+	switch {
+	case amount <= 0:
+		return "invalid_amount", "Amount must be positive"
+	case amount > MaxTransferAmount:
+		return "amount_too_large", "Amount exceeds maximum transfer"
+	case toUser == userID:
+		return "self_transfer", "cannot transfer to yourself"
+	case utf8.RuneCountInString(memo) > MaxMemoLength:
+		return "memo_too_long", fmt.Sprintf("memo must be at most %d characters", MaxMemoLength)
+	}
+	return "", ""
+}
+
+// nullableMemo stores an empty memo as NULL
+func nullableMemo(memo string) sql.NullString {
+	return sql.NullString{String: memo, Valid: memo != ""}
+}
+
+// transferCheck is the outcome of checkTransfer
+type transferCheck struct {
+	Status           int    // HTTP status to report Reason with
+	Code             string // Error code for Reason
+	Reason           string // First failed check, or "" if all passed
+	Balance          int64  // Sender's current balance
+	Version          int64  // Sender's row version, for optimistic concurrency
+	Currency         string // Sender's currency
+	RecipientVersion int64  // Recipient's row version, for optimistic concurrency
+}
+
+// checkTransfer runs the sender, recipient, and limit checks shared by transfers and holds.
+// Whether the sender can afford the amount is left to the conditional debit, which
+// checks and spends in one statement.
+func checkTransfer(ctx context.Context, tx *sql.Tx, userID, toUser int, amount int64) (transferCheck, error) {
+	var check transferCheck
+
+	var senderFrozen bool
+	err := tx.QueryRowContext(ctx, "SELECT balance, version, currency, frozen FROM users WHERE id = ?", userID).Scan(&check.Balance, &check.Version, &check.Currency, &senderFrozen)
+	if err != nil {
+		return check, err
+	}
+
+	// Make sure the recipient exists before touching any balance
+	recipientExists := true
+	var recipientCurrency string
+	var recipientBalance int64
+	err = tx.QueryRowContext(ctx, "SELECT currency, balance, version FROM users WHERE id = ?", toUser).Scan(&recipientCurrency, &recipientBalance, &check.RecipientVersion)
+	if err == sql.ErrNoRows {
+		recipientExists = false
+	} else if err != nil {
+		return check, err
+	}
+
+	// Today's completed and pending outgoing transfers count toward the daily limit; refunded ones don't
+	startOfDay := time.Now().UTC().Truncate(24 * time.Hour).Format(time.RFC3339)
+	var sentToday int64
+	err = tx.QueryRowContext(ctx, "SELECT COALESCE(SUM(amount), 0) FROM transactions WHERE from_user = ? AND status IN ('COMPLETED', 'PENDING') AND timestamp >= ?",
+		userID, startOfDay).Scan(&sentToday)
+	if err != nil {
+		return check, err
+	}
+
+	_, canCredit := checkedAdd(recipientBalance, amount)
+	bounds, hasBounds := TransferBounds[check.Currency]
+
+	switch {
+	case senderFrozen:
+		check.Status, check.Code, check.Reason = http.StatusLocked, "account_frozen", "account frozen"
+	case !recipientExists:
+		check.Status, check.Code, check.Reason = http.StatusNotFound, "recipient_not_found", "recipient not found"
+	case recipientCurrency != check.Currency:
+		// No conversion yet, so both sides must hold the same currency
+		check.Status, check.Code, check.Reason = http.StatusUnprocessableEntity, "currency_mismatch", "currency mismatch"
+	case hasBounds && amount < bounds.Min:
+		check.Status, check.Code = http.StatusBadRequest, "amount_below_minimum"
+		check.Reason = "amount must be at least " + Money{Amount: bounds.Min, Currency: check.Currency}.String()
+	case hasBounds && amount > bounds.Max:
+		check.Status, check.Code = http.StatusBadRequest, "amount_above_maximum"
+		check.Reason = "amount must be at most " + Money{Amount: bounds.Max, Currency: check.Currency}.String()
+	case sentToday+amount > DailyTransferLimit:
+		check.Status, check.Code, check.Reason = http.StatusTooManyRequests, "daily_limit_exceeded", "daily limit exceeded"
+	case !canCredit:
+		// Abort rather than let the recipient's balance wrap negative
+		check.Status, check.Code, check.Reason = http.StatusUnprocessableEntity, "recipient_balance_overflow", "recipient balance would overflow"
+	}
+	return check, nil
+}
+
+// writeDryRun reports whether a transfer would succeed without moving any money.
+// An empty reason means every check passed; balance is what the sender would be left with.
+func writeDryRun(w http.ResponseWriter, reason string, balance int64) {
+	resp := map[string]interface{}{
+		"would_succeed":     reason == "",
+		"resulting_balance": balance,
+	}
+	if reason != "" {
+		resp["reason"] = reason
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// errFeeCurrency means the fee collector's account holds a different currency than the transfer
+var errFeeCurrency = errors.New("fee collector currency mismatch")
+
+// checkFeeCollector confirms the fee collector's account can be credited a fee in currency
+func checkFeeCollector(ctx context.Context, tx *sql.Tx, currency string) error {
+	var collectorCurrency string
+	if err := tx.QueryRowContext(ctx, "SELECT currency FROM users WHERE id = ?", FeeCollectorID).Scan(&collectorCurrency); err != nil {
+		log.Printf("Fee collector %d: %v", FeeCollectorID, err)
+		return err
+	}
+	if collectorCurrency != currency {
+		return errFeeCurrency
+	}
+	return nil
+}
+
+// collectFee credits fee to the fee collector. The fee is its own FEE entry, linked to
+// the transfer it was charged on, so the collector's statement and reconciliation see it.
+func collectFee(ctx context.Context, tx *sql.Tx, fromUser int, fee int64, currency string, parentID int64) error {
+	if err := execOne(ctx, tx, "UPDATE users SET balance = balance + ?, version = version + 1 WHERE id = ?", fee, FeeCollectorID); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(ctx, "INSERT INTO transactions (from_user, to_user, amount, currency, timestamp, status, parent_transaction_id) VALUES (?, ?, ?, ?, ?, 'FEE', ?)",
+		fromUser, FeeCollectorID, fee, currency, time.Now().UTC().Format(time.RFC3339), parentID)
+	return err
+}
+
+// RefundTransaction allows a user to request a refund for a transaction they sent
+// Intention: If you sent money by mistake, you can reverse it if it's recent.
+// Admins (support staff) may refund any transaction on a user's behalf.
+func RefundTransaction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed")
+		return
+	}
+	userID := r.Context().Value("user_id").(int)
+
+	type RefundReq struct {
+		TransactionID int `json:"transaction_id"`
+	}
+	var req RefundReq
+	if !decodeJSONBody(w, r, &req, MaxBodyBytes) {
+		return
+	}
+
+	ctx, cancel := queryContext(r)
+	defer cancel()
+
+	// The reversal reads and writes in one transaction so it either fully applies or not at all
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError, "refund_failed", "Refund failed")
+		return
+	}
+	defer tx.Rollback() // No-op once committed
+
+	var frozen bool
+	if err := tx.QueryRowContext(ctx, "SELECT frozen FROM users WHERE id = ?", userID).Scan(&frozen); err != nil {
+		dbError(w, err, http.StatusInternalServerError, "refund_failed", "Refund failed")
+		return
+	}
+	if frozen {
+		writeError(w, http.StatusLocked, "account_frozen", "account frozen")
+		return
+	}
+
+	// Retrieve transaction to verify ownership
+	var fromUser, toUser int
+	var amount int64
+	var currency, status, timestamp string
+
+	err = tx.QueryRowContext(ctx, "SELECT from_user, to_user, amount, currency, timestamp, status FROM transactions WHERE id = ?", req.TransactionID).Scan(&fromUser, &toUser, &amount, &currency, &timestamp, &status)
+	if err != nil {
+		dbError(w, err, http.StatusNotFound, "transaction_not_found", "Transaction not found")
+		return
+	}
+
+	// Verify the requester is the one who originally sent the money, or an admin
+	if fromUser != userID && !isAdmin(r) {
+		writeError(w, http.StatusForbidden, "forbidden", "Unauthorized")
+		return
+	}
+
+	// Holds never moved money, a refunded transfer has already been reversed, a
+	// reversal is itself the undo of a refund, and fees are refunded along with their transfer
+	if status == "PENDING" || status == "RELEASED" || status == "REFUNDED" || status == "REVERSAL" || status == "FEE" {
+		writeError(w, http.StatusConflict, "not_refundable", "transaction cannot be refunded")
+		return
+	}
+
+	// Only recent transactions can be reversed
+	sentAt, err := time.Parse(time.RFC3339, timestamp)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "corrupt_timestamp", "Corrupt transaction timestamp")
+		return
+	}
+	if time.Since(sentAt) > RefundWindow {
+		writeError(w, http.StatusForbidden, "refund_window_expired", "refund window expired")
+		return
+	}
+
+	// Logic: Reverse the money flow
+	// Deduct from recipient, refusing to drive their balance negative if they already spent it
+	// (or reserved it for a hold)
+	res, err := tx.ExecContext(ctx, "UPDATE users SET balance = balance - ?, version = version + 1 WHERE id = ? AND balance - held >= ?", amount, toUser, amount)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError, "refund_failed", "Refund failed")
+		return
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError, "refund_failed", "Refund failed")
+		return
+	}
+	if affected == 0 {
+		writeError(w, http.StatusUnprocessableEntity, "recipient_insufficient_funds", "recipient has insufficient funds for reversal")
+		return
+	}
+
+	// Credit original sender. Each step must update its row, or the refund is abandoned
+	// before the status changes: a missing sender would otherwise swallow the money.
+	if err := execOne(ctx, tx, "UPDATE users SET balance = balance + ?, version = version + 1 WHERE id = ?", amount, fromUser); err != nil {
+		dbError(w, err, http.StatusInternalServerError, "refund_failed", "Refund failed")
+		return
+	}
+
+	// Update Status
+	// Note: We update the status to prevent future confusion in UI
+	// refunded_by keeps an audit trail of who (sender or admin) issued the refund
+	if err := execOne(ctx, tx, "UPDATE transactions SET status = 'REFUNDED', refunded_by = ? WHERE id = ?", userID, req.TransactionID); err != nil {
+		dbError(w, err, http.StatusInternalServerError, "refund_failed", "Refund failed")
+		return
+	}
+
+	// Record the reversal as its own entry with a negative amount, linked to the
+	// original, so statements show when the money moved back and who moved it
+	res, err = tx.ExecContext(ctx, "INSERT INTO transactions (from_user, to_user, amount, currency, timestamp, status, refunded_by, refund_transaction_id) VALUES (?, ?, ?, ?, ?, 'REVERSAL', ?, ?)",
+		fromUser, toUser, -amount, currency, time.Now().UTC().Format(time.RFC3339), userID, req.TransactionID)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError, "refund_failed", "Refund failed")
+		return
+	}
+	reversalID, err := res.LastInsertId()
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError, "refund_failed", "Refund failed")
+		return
+	}
+
+	// With RefundFees, the fee charged on the transfer goes back to the sender too
+	var feeRefunded int64
+	if RefundFees {
+		var feeID, collector int
+		var fee int64
+		err := tx.QueryRowContext(ctx, "SELECT id, to_user, amount FROM transactions WHERE parent_transaction_id = ? AND status = 'FEE'", req.TransactionID).Scan(&feeID, &collector, &fee)
+		if err != nil && err != sql.ErrNoRows {
+			dbError(w, err, http.StatusInternalServerError, "refund_failed", "Refund failed")
+			return
+		}
+		if err == nil {
+			if err := execOne(ctx, tx, "UPDATE users SET balance = balance - ?, version = version + 1 WHERE id = ? AND balance - held >= ?", fee, collector, fee); errors.Is(err, errNoRowsAffected) {
+				writeError(w, http.StatusUnprocessableEntity, "collector_insufficient_funds", "fee collector cannot cover the fee refund")
+				return
+			} else if err != nil {
+				dbError(w, err, http.StatusInternalServerError, "refund_failed", "Refund failed")
+				return
+			}
+			if err := execOne(ctx, tx, "UPDATE users SET balance = balance + ?, version = version + 1 WHERE id = ?", fee, fromUser); err != nil {
+				dbError(w, err, http.StatusInternalServerError, "refund_failed", "Refund failed")
+				return
+			}
+			if err := execOne(ctx, tx, "UPDATE transactions SET status = 'REFUNDED', refunded_by = ? WHERE id = ?", userID, feeID); err != nil {
+				dbError(w, err, http.StatusInternalServerError, "refund_failed", "Refund failed")
+				return
+			}
+			_, err = tx.ExecContext(ctx, "INSERT INTO transactions (from_user, to_user, amount, currency, timestamp, status, refunded_by, refund_transaction_id) VALUES (?, ?, ?, ?, ?, 'REVERSAL', ?, ?)",
+				fromUser, collector, -fee, currency, time.Now().UTC().Format(time.RFC3339), userID, feeID)
+			if err != nil {
+				dbError(w, err, http.StatusInternalServerError, "refund_failed", "Refund failed")
+				return
+			}
+			feeRefunded = fee
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		dbError(w, err, http.StatusInternalServerError, "refund_failed", "Refund failed")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "refunded", "reversal_transaction_id": reversalID, "fee_refunded": feeRefunded})
+}
+
+// FreezeAccount blocks a user from sending money or issuing refunds (admin only)
+func FreezeAccount(w http.ResponseWriter, r *http.Request) {
+	setFrozen(w, r, true)
+}
+
+// UnfreezeAccount lifts a freeze placed by FreezeAccount (admin only)
+func UnfreezeAccount(w http.ResponseWriter, r *http.Request) {
+	setFrozen(w, r, false)
+}
+
+func setFrozen(w http.ResponseWriter, r *http.Request, frozen bool) {
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed")
+		return
+	}
+
+	type FreezeReq struct {
+		UserID int `json:"user_id"`
+	}
+	var req FreezeReq
+	if !decodeJSONBody(w, r, &req, MaxBodyBytes) {
+		return
+	}
+
+	ctx, cancel := queryContext(r)
+	defer cancel()
+
+	res, err := db.ExecContext(ctx, "UPDATE users SET frozen = ? WHERE id = ?", frozen, req.UserID)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		writeError(w, http.StatusNotFound, "user_not_found", "User not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"user_id": req.UserID, "frozen": frozen})
+}
+
+// ReconcileReport is the result of an admin reconciliation run
+type ReconcileReport struct {
+	Balanced           bool                 `json:"balanced"`
+	Totals             []CurrencyTotal      `json:"totals"`
+	Accounts           []AccountDiscrepancy `json:"accounts"`            // Balances not explained by transaction history
+	OrphanTransactions []int                `json:"orphan_transactions"` // COMPLETED transfers missing a debit or credit side
+}
+
+// CurrencyTotal compares the money in the system against what was put in from outside
+type CurrencyTotal struct {
+	Currency string `json:"currency"`
+	Balance  int64  `json:"balance"`  // Sum of all user balances
+	Expected int64  `json:"expected"` // Sum of opening balances (seed data and external credits)
+}
+
+// AccountDiscrepancy is an account whose stored figures disagree with its history
+type AccountDiscrepancy struct {
+	UserID          int   `json:"user_id"`
+	Balance         int64 `json:"balance"`
+	ExpectedBalance int64 `json:"expected_balance"` // Opening balance plus net transfers and reversals
+	Held            int64 `json:"held"`
+	ExpectedHeld    int64 `json:"expected_held"` // Sum of the account's PENDING holds
+}
+
+// Reconcile checks that the ledger is internally consistent. It is read-only.
+func Reconcile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed")
+		return
+	}
+
+	ctx, cancel := queryContext(r)
+	defer cancel()
+
+	// One transaction so every check sees the same snapshot
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+	defer tx.Rollback() // Nothing is written
+
+	report := ReconcileReport{Totals: []CurrencyTotal{}, Accounts: []AccountDiscrepancy{}, OrphanTransactions: []int{}}
+
+	// Transfers only move money between accounts, so totals must match what was put in
+	rows, err := tx.QueryContext(ctx, "SELECT currency, COALESCE(SUM(balance), 0), COALESCE(SUM(opening_balance), 0) FROM users GROUP BY currency ORDER BY currency")
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+	for rows.Next() {
+		var t CurrencyTotal
+		if err := rows.Scan(&t.Currency, &t.Balance, &t.Expected); err != nil {
+			rows.Close()
+			dbError(w, err, http.StatusInternalServerError, "database_error", "Database error")
+			return
+		}
+		report.Totals = append(report.Totals, t)
+	}
+	rows.Close()
+
+	// Each account must equal its opening balance plus transfers and fees in minus out (refunded
+	// transfers cancel against their REVERSAL rows), and its held funds must equal its pending holds
+	rows, err = tx.QueryContext(ctx, `SELECT u.id, u.balance, u.held,
+		COALESCE(u.opening_balance, 0) + COALESCE((SELECT SUM(CASE WHEN t.to_user = u.id THEN t.amount ELSE -t.amount END)
+			FROM transactions t WHERE t.status IN ('COMPLETED', 'REFUNDED', 'REVERSAL', 'FEE') AND (t.from_user = u.id OR t.to_user = u.id)), 0),
+		COALESCE((SELECT SUM(amount) FROM transactions WHERE from_user = u.id AND status = 'PENDING'), 0)
+		FROM users u ORDER BY u.id`)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+	for rows.Next() {
+		var a AccountDiscrepancy
+		if err := rows.Scan(&a.UserID, &a.Balance, &a.Held, &a.ExpectedBalance, &a.ExpectedHeld); err != nil {
+			rows.Close()
+			dbError(w, err, http.StatusInternalServerError, "database_error", "Database error")
+			return
+		}
+		if a.Balance != a.ExpectedBalance || a.Held != a.ExpectedHeld {
+			report.Accounts = append(report.Accounts, a)
+		}
+	}
+	rows.Close()
+
+	// A completed transfer needs an existing sender to debit and recipient to credit
+	rows, err = tx.QueryContext(ctx, `SELECT id FROM transactions t WHERE t.status = 'COMPLETED' AND (t.amount <= 0
+		OR NOT EXISTS (SELECT 1 FROM users WHERE id = t.from_user)
+		OR NOT EXISTS (SELECT 1 FROM users WHERE id = t.to_user)) ORDER BY id`)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			dbError(w, err, http.StatusInternalServerError, "database_error", "Database error")
+			return
+		}
+		report.OrphanTransactions = append(report.OrphanTransactions, id)
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		dbError(w, err, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+	rows.Close()
+
+	report.Balanced = len(report.Accounts) == 0 && len(report.OrphanTransactions) == 0
+	for _, t := range report.Totals {
+		if t.Balance != t.Expected {
+			report.Balanced = false
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// Page sizes for SearchTransactions
+const (
+	DefaultSearchLimit = 50
+	MaxSearchLimit     = 200
+)
+
+// SearchTransactions finds transactions by amount range, status, and counterparty,
+// newest first. Regular users only see transactions they sent or received; admins
+// search every account, or one account with account_id.
+func SearchTransactions(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(int)
+	q := r.URL.Query()
+
+	// parseInt reads an optional non-negative integer parameter
+	parseInt := func(name string, def int64) (int64, bool) {
+		v := q.Get(name)
+		if v == "" {
+			return def, true
+		}
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			writeError(w, http.StatusBadRequest, "invalid_"+name, name+" must be a non-negative integer")
+			return 0, false
+		}
+		return n, true
+	}
+
+	// account 0 means every account, which only admins may search
+	account, ok := parseInt("account_id", 0)
+	if !ok {
+		return
+	}
+	if !isAdmin(r) {
+		if account != 0 && account != int64(userID) {
+			writeError(w, http.StatusForbidden, "forbidden", "Unauthorized")
+			return
+		}
+		account = int64(userID)
+	}
+	counterparty, ok := parseInt("counterparty", 0)
+	if !ok {
+		return
+	}
+	minAmount, ok := parseInt("min_amount", 0)
+	if !ok {
+		return
+	}
+	maxAmount, ok := parseInt("max_amount", math.MaxInt64)
+	if !ok {
+		return
+	}
+	if minAmount > maxAmount {
+		writeError(w, http.StatusBadRequest, "invalid_amount_range", "min_amount must not exceed max_amount")
+		return
+	}
+	limit, ok := parseInt("limit", DefaultSearchLimit)
+	if !ok {
+		return
+	}
+	if limit == 0 || limit > MaxSearchLimit {
+		writeError(w, http.StatusBadRequest, "invalid_limit", fmt.Sprintf("limit must be between 1 and %d", MaxSearchLimit))
+		return
+	}
+	offset, ok := parseInt("offset", 0)
+	if !ok {
+		return
+	}
+	status := strings.ToUpper(q.Get("status"))
+	if status != "" && !transactionStatuses[status] {
+		writeError(w, http.StatusBadRequest, "invalid_status", "status must be one of PENDING, COMPLETED, RELEASED, REFUNDED, REVERSAL, FEE")
+		return
+	}
+
+	// Every value is a bound parameter; only fixed clauses are concatenated
+	where := "amount >= ? AND amount <= ?"
+	args := []interface{}{minAmount, maxAmount}
+	switch {
+	case account != 0 && counterparty != 0:
+		where += " AND ((from_user = ? AND to_user = ?) OR (from_user = ? AND to_user = ?))"
+		args = append(args, account, counterparty, counterparty, account)
+	case account != 0:
+		where += " AND (from_user = ? OR to_user = ?)"
+		args = append(args, account, account)
+	case counterparty != 0:
+		where += " AND (from_user = ? OR to_user = ?)"
+		args = append(args, counterparty, counterparty)
+	}
+	if status != "" {
+		where += " AND status = ?"
+		args = append(args, status)
+	}
+	// Fetch one extra row to tell whether there is a next page
+	args = append(args, limit+1, offset)
 
-// Global DB instance
-var db *sql.DB
+	ctx, cancel := queryContext(r)
+	defer cancel()
 
-// --- INITIALIZATION ---
-func initDB() {
-	var err error
-	db, err = sql.Open("sqlite3", DBName)
+	rows, err := db.QueryContext(ctx, "SELECT "+transactionColumns+" FROM transactions WHERE "+where+" ORDER BY id DESC LIMIT ? OFFSET ?", args...)
 	if err != nil {
-		log.Fatal(err)
-	}
-
-	// Create tables
-	queries := []string{
-		`CREATE TABLE IF NOT EXISTS users (id INTEGER PRIMARY KEY, username TEXT, balance INTEGER, api_key TEXT)`,
-		`CREATE TABLE IF NOT EXISTS transactions (id INTEGER PRIMARY KEY, from_user INTEGER, to_user INTEGER, amount INTEGER, timestamp TEXT, status TEXT)`,
+		dbError(w, err, http.StatusInternalServerError, "database_error", "Database error")
+		return
 	}
+	defer rows.Close()
 
-	for _, q := range queries {
-		_, err = db.Exec(q)
+	txns := []Transaction{}
+	for rows.Next() {
+		t, err := scanTransaction(rows)
 		if err != nil {
-			log.Fatal(err)
+			dbError(w, err, http.StatusInternalServerError, "database_error", "Database error")
+			return
 		}
+		txns = append(txns, t)
+	}
+	if err := rows.Err(); err != nil {
+		dbError(w, err, http.StatusInternalServerError, "database_error", "Database error")
+		return
 	}
 
-	// Seed data check
-	var count int
-	db.QueryRow("SELECT count(*) FROM users").Scan(&count)
-	if count == 0 {
-		db.Exec("INSERT INTO users (username, balance, api_key) VALUES (?, ?, ?)", "alice", 10000, "secret_alice_123") // $100.00
-		db.Exec("INSERT INTO users (username, balance, api_key) VALUES (?, ?, ?)", "bob", 5000, "secret_bob_456")     // $50.00
-		db.Exec("INSERT INTO users (username, balance, api_key) VALUES (?, ?, ?)", "mallory", 1000, "secret_mal_789") // $10.00
+	resp := map[string]interface{}{"transactions": txns}
+	if int64(len(txns)) > limit {
+		resp["transactions"] = txns[:limit]
+		resp["next_offset"] = offset + limit
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// GetTransaction returns a single transaction so clients can poll its status.
+// Only the sender, the recipient, or an admin may view it.
+func GetTransaction(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(int)
+
+	txnID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_transaction_id", "Invalid transaction id")
+		return
+	}
+
+	ctx, cancel := queryContext(r)
+	defer cancel()
+
+	t, err := scanTransaction(db.QueryRowContext(ctx, "SELECT "+transactionColumns+" FROM transactions WHERE id = ?", txnID))
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, "transaction_not_found", "Transaction not found")
+		return
+	}
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+	if t.FromUser != userID && t.ToUser != userID && !isAdmin(r) {
+		writeError(w, http.StatusForbidden, "forbidden", "Unauthorized")
+		return
 	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t)
 }
 
-// --- MIDDLEWARE ---
+// GetStatement exports transaction history for reporting
+func GetStatement(w http.ResponseWriter, r *http.Request) {
+	// Intention: Admin or User requests a statement.
+	// We support filtering by account_id for flexibility.
+	userID := r.Context().Value("user_id").(int)
 
-// AuthMiddleware simulates checking an API Key and adding the user ID to the context
-func AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		apiKey := r.Header.Get("X-API-Key")
-		if apiKey == "" {
-			http.Error(w, "Missing API Key", http.StatusUnauthorized)
+	rawAccountID := r.URL.Query().Get("account_id")
+	if rawAccountID == "" {
+		writeError(w, http.StatusBadRequest, "account_id_required", "account_id required")
+		return
+	}
+	targetAccountID, err := strconv.Atoi(rawAccountID)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_account_id", "Invalid account_id")
+		return
+	}
+
+	// Users may only read their own statement; admins may read any
+	if targetAccountID != userID && !isAdmin(r) {
+		writeError(w, http.StatusForbidden, "forbidden", "Unauthorized")
+		return
+	}
+
+	// direction selects outgoing, incoming, or all transactions for the account
+	var where string
+	var args []interface{}
+	switch r.URL.Query().Get("direction") {
+	case "sent":
+		where, args = "from_user = ?", []interface{}{targetAccountID}
+	case "received":
+		where, args = "to_user = ?", []interface{}{targetAccountID}
+	case "", "all":
+		where, args = "from_user = ? OR to_user = ?", []interface{}{targetAccountID, targetAccountID}
+	default:
+		writeError(w, http.StatusBadRequest, "invalid_direction", "direction must be sent, received, or all")
+		return
+	}
+
+	// Optional date range; a date-only "to" covers that whole day
+	where = "(" + where + ")"
+	if v := r.URL.Query().Get("from"); v != "" {
+		from, err := parseStatementDate(v, false)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_date", "invalid date")
 			return
 		}
-
-		var userID int
-		// Simple lookup
-		err := db.QueryRow("SELECT id FROM users WHERE api_key = ?", apiKey).Scan(&userID)
+		where += " AND timestamp >= ?"
+		args = append(args, from)
+	}
+	if v := r.URL.Query().Get("to"); v != "" {
+		to, err := parseStatementDate(v, true)
 		if err != nil {
-			http.Error(w, "Invalid API Key", http.StatusUnauthorized)
+			writeError(w, http.StatusBadRequest, "invalid_date", "invalid date")
 			return
 		}
+		where += " AND timestamp <= ?"
+		args = append(args, to)
+	}
 
-		// Add user ID to context
-		ctx := context.WithValue(r.Context(), "user_id", userID)
-		next(w, r.WithContext(ctx))
+	ctx, cancel := queryContext(r)
+	defer cancel()
+
+	// Query transactions, oldest first, with the running balance
+	args = append([]interface{}{targetAccountID, targetAccountID, targetAccountID, targetAccountID}, args...)
+	rows, err := db.QueryContext(ctx, runningBalanceCTE+"SELECT "+transactionColumns+", balance_after FROM transactions JOIN running ON running_id = id WHERE "+where+" ORDER BY timestamp, id", args...)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+	defer rows.Close()
+
+	// Spreadsheet export via ?format=csv or Accept: text/csv
+	if r.URL.Query().Get("format") == "csv" || strings.Contains(r.Header.Get("Accept"), "text/csv") {
+		writeStatementCSV(w, rows)
+		return
+	}
+
+	var txns []StatementLine
+	for rows.Next() {
+		line, err := scanStatementLine(rows)
+		if err != nil {
+			continue
+		}
+		txns = append(txns, line)
+	}
+	if err := rows.Err(); err != nil {
+		dbError(w, err, http.StatusInternalServerError, "database_error", "Database error")
+		return
 	}
+
+	json.NewEncoder(w).Encode(txns)
 }
 
-// --- HANDLERS ---
+// BalancePoint is one sample of a balance history
+type BalancePoint struct {
+	Timestamp string `json:"timestamp"` // RFC3339, or YYYY-MM-DD for daily granularity
+	Balance   Money  `json:"balance"`
+}
 
-// GetBalance returns the authenticated user's balance
-func GetBalance(w http.ResponseWriter, r *http.Request) {
+// GetBalanceHistory returns the caller's balance over time, reconstructed from their
+// transactions. granularity=per_transaction (default) gives the balance after every
+// money movement; granularity=daily gives the closing balance of each day with activity.
+func GetBalanceHistory(w http.ResponseWriter, r *http.Request) {
 	userID := r.Context().Value("user_id").(int)
 
-	var balance int64
-	err := db.QueryRow("SELECT balance FROM users WHERE id = ?", userID).Scan(&balance)
+	granularity := r.URL.Query().Get("granularity")
+	switch granularity {
+	case "":
+		granularity = "per_transaction"
+	case "per_transaction", "daily":
+	default:
+		writeError(w, http.StatusBadRequest, "invalid_granularity", "granularity must be per_transaction or daily")
+		return
+	}
+
+	ctx, cancel := queryContext(r)
+	defer cancel()
+
+	var currency string
+	if err := db.QueryRowContext(ctx, "SELECT currency FROM users WHERE id = ?", userID).Scan(&currency); err != nil {
+		dbError(w, err, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+
+	// Holds and released holds never changed the balance, so they are not points
+	rows, err := db.QueryContext(ctx, runningBalanceCTE+"SELECT timestamp, balance_after FROM transactions JOIN running ON running_id = id WHERE status IN ('COMPLETED', 'REFUNDED', 'REVERSAL', 'FEE') ORDER BY timestamp, id",
+		userID, userID, userID, userID)
 	if err != nil {
-		http.Error(w, "Database error", http.StatusInternalServerError)
+		dbError(w, err, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+	defer rows.Close()
+
+	points := []BalancePoint{}
+	for rows.Next() {
+		var p BalancePoint
+		if err := rows.Scan(&p.Timestamp, &p.Balance); err != nil {
+			dbError(w, err, http.StatusInternalServerError, "database_error", "Database error")
+			return
+		}
+		p.Balance.Currency = currency
+
+		if granularity == "daily" {
+			// Rows are chronological, so the last one seen for a day is its closing balance
+			p.Timestamp = p.Timestamp[:min(len(p.Timestamp), len("2006-01-02"))]
+			if n := len(points); n > 0 && points[n-1].Timestamp == p.Timestamp {
+				points[n-1] = p
+				continue
+			}
+		}
+		points = append(points, p)
+	}
+	if err := rows.Err(); err != nil {
+		dbError(w, err, http.StatusInternalServerError, "database_error", "Database error")
 		return
 	}
 
+	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"user_id": userID,
-		"balance": balance,
+		"user_id":     userID,
+		"granularity": granularity,
+		"points":      points,
 	})
 }
 
-// TransferHandler processes peer-to-peer payments
-// Intention: Users send money to others.
-func TransferHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+// writeStatementCSV streams statement rows as CSV one at a time, so large
+// statements are never held in memory.
+func writeStatementCSV(w http.ResponseWriter, rows *sql.Rows) {
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", "attachment; filename=statement.csv")
+
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"id", "from_user", "to_user", "amount", "timestamp", "status", "currency", "memo", "balance_after"})
+	for rows.Next() {
+		line, err := scanStatementLine(rows)
+		if err != nil {
+			continue
+		}
+		t := line.Transaction
+		cw.Write([]string{
+			strconv.Itoa(t.ID),
+			strconv.Itoa(t.FromUser),
+			strconv.Itoa(t.ToUser),
+			strconv.FormatInt(t.Amount.Amount, 10),
+			t.Timestamp,
+			t.Status,
+			t.Amount.Currency,
+			t.Memo,
+			strconv.FormatInt(line.BalanceAfter.Amount, 10),
+		})
 	}
+	cw.Flush()
+}
 
-	userID := r.Context().Value("user_id").(int)
+// runningBalanceCTE computes, for every transaction touching an account, the account's
+// balance right after it. Completed and refunded transfers and fees moved money, and a
+// refund's REVERSAL row (negative amount) moves it back, so the opening balance is the current
+// balance minus their net effect, and a running sum in (timestamp, id) order walks
+// forward from there. Being part of the statement query, it reads one consistent
+// snapshot. Takes the account id four times.
+const runningBalanceCTE = `WITH effects AS (
+	SELECT id AS effect_id, timestamp AS effect_time,
+		CASE WHEN status NOT IN ('COMPLETED', 'REFUNDED', 'REVERSAL', 'FEE') THEN 0 WHEN to_user = ? THEN amount ELSE -amount END AS effect
+	FROM transactions WHERE from_user = ? OR to_user = ?
+), running AS (
+	SELECT effect_id AS running_id,
+		(SELECT balance FROM users WHERE id = ?) - (SELECT COALESCE(SUM(effect), 0) FROM effects)
+			+ SUM(effect) OVER (ORDER BY effect_time, effect_id) AS balance_after
+	FROM effects
+) `
+
+// StatementLine is a statement row: the transaction and the account balance right after it
+type StatementLine struct {
+	Transaction
+	BalanceAfter Money `json:"balance_after"`
+}
+
+// scanStatementLine reads transactionColumns followed by balance_after
+func scanStatementLine(row rowScanner) (StatementLine, error) {
+	var line StatementLine
+	var refundedBy, refundOf, parent sql.NullInt64
+	var memo sql.NullString
+	t := &line.Transaction
+	err := row.Scan(&t.ID, &t.FromUser, &t.ToUser, &t.Amount, &t.Amount.Currency, &t.Timestamp, &t.Status, &refundedBy, &memo, &refundOf, &parent, &line.BalanceAfter)
+	t.RefundedBy = int(refundedBy.Int64)
+	t.Memo = memo.String
+	t.RefundTransactionID = int(refundOf.Int64)
+	t.ParentTransactionID = int(parent.Int64)
+	line.BalanceAfter.Currency = t.Amount.Currency
+	return line, err
+}
 
-	type RequestBody struct {
-		ToUser int   `json:"to_user"`
-		Amount int64 `json:"amount"`
+// parseStatementDate accepts RFC3339 or YYYY-MM-DD and returns a UTC RFC3339 string
+// comparable with stored transaction timestamps. For date-only input, endOfDay selects
+// the last second of that day instead of midnight.
+func parseStatementDate(v string, endOfDay bool) (string, error) {
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		t, err = time.Parse("2006-01-02", v)
+		if err != nil {
+			return "", err
+		}
+		if endOfDay {
+			t = t.Add(24*time.Hour - time.Second)
+		}
 	}
+	return t.UTC().Format(time.RFC3339), nil
+}
 
-	var req RequestBody
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid body", http.StatusBadRequest)
-		return
+// --- WEBHOOKS ---
+
+// WebhookTimeout bounds a single webhook delivery attempt
+const WebhookTimeout = 10 * time.Second
+
+// webhookClient refuses to connect to internal addresses. The check runs on the
+// resolved IP at dial time, so it also covers redirects and DNS records that
+// change after the URL was registered.
+var webhookClient = &http.Client{
+	Timeout: WebhookTimeout,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: WebhookTimeout,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				addr, err := netip.ParseAddr(host)
+				if err != nil {
+					return err
+				}
+				return checkWebhookAddr(addr)
+			},
+		}).DialContext,
+		TLSHandshakeTimeout: WebhookTimeout,
+	},
+}
+
+// errInternalAddress is returned for webhook destinations on internal networks
+var errInternalAddress = errors.New("webhook destination is an internal address")
+
+// checkWebhookAddr rejects loopback, private (RFC 1918 and fc00::/7), link-local,
+// multicast and unspecified addresses
+func checkWebhookAddr(addr netip.Addr) error {
+	addr = addr.Unmap()
+	if !addr.IsValid() || addr.IsLoopback() || addr.IsPrivate() || addr.IsLinkLocalUnicast() ||
+		addr.IsLinkLocalMulticast() || addr.IsInterfaceLocalMulticast() || addr.IsMulticast() || addr.IsUnspecified() {
+		return fmt.Errorf("%w: %s", errInternalAddress, addr)
 	}
+	return nil
+}
+
+// Webhook retry schedule: attempt n+1 waits WebhookBaseDelay * 4^(n-1) after attempt n
+// (1s, 4s, 16s, 64s), and a delivery is marked FAILED after WebhookMaxAttempts.
+const (
+	WebhookMaxAttempts  = 5
+	WebhookBaseDelay    = time.Second
+	WebhookPollInterval = time.Second
+	webhookBatchSize    = 50
+)
+
+// webhookWake nudges the delivery worker when a new delivery is queued
+var webhookWake = make(chan struct{}, 1)
+
+// webhookWG lets shutdown wait for the delivery worker before closing the database
+var webhookWG sync.WaitGroup
+
+// TransferEvent is the JSON body POSTed to a recipient's webhook
+type TransferEvent struct {
+	Type          string `json:"type"`
+	TransactionID int64  `json:"transaction_id"`
+	Amount        Money  `json:"amount"`
+	FromUser      int    `json:"from_user"`
+	ToUser        int    `json:"to_user"`
+}
+
+// WebhookDelivery is one queued event and the history of attempts to deliver it
+type WebhookDelivery struct {
+	ID            int             `json:"id"`
+	TransactionID int             `json:"transaction_id"`
+	EventType     string          `json:"event_type"`
+	Payload       json.RawMessage `json:"payload"`
+	Status        string          `json:"status"` // 'PENDING', 'DELIVERED', 'FAILED'
+	Attempts      int             `json:"attempts"`
+	LastError     string          `json:"last_error,omitempty"`
+	NextAttemptAt string          `json:"next_attempt_at,omitempty"`
+	CreatedAt     string          `json:"created_at"`
+	UpdatedAt     string          `json:"updated_at"`
+}
 
-	if req.Amount <= 0 {
-		http.Error(w, "Amount must be positive", http.StatusBadRequest)
+// RegisterWebhook sets the caller's webhook URL, replacing any existing one.
+// A new signing secret is generated and only shown in this response.
+func RegisterWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed")
 		return
 	}
+	userID := r.Context().Value("user_id").(int)
 
-	// 1. Check Sender Balance
-	var currentBalance int64
-	err := db.QueryRow("SELECT balance FROM users WHERE id = ?", userID).Scan(&currentBalance)
-	if err != nil {
-		http.Error(w, "User not found", http.StatusInternalServerError)
+	type WebhookReq struct {
+		URL string `json:"url"`
+	}
+	var req WebhookReq
+	if !decodeJSONBody(w, r, &req, MaxBodyBytes) {
 		return
 	}
-
-	if currentBalance < req.Amount {
-		http.Error(w, "Insufficient funds", http.StatusBadRequest)
+	u, err := url.Parse(req.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		writeError(w, http.StatusBadRequest, "invalid_url", "url must be an absolute http(s) URL")
 		return
 	}
 
-	// Simulate Fraud Detection / Compliance Check Latency
-	// This represents calls to external GRPC services
-	time.Sleep(200 * time.Millisecond)
+	ctx, cancel := queryContext(r)
+	defer cancel()
 
-	// 2. Perform Transfer (Update Sender)
-	_, err = db.Exec("UPDATE users SET balance = balance - ? WHERE id = ?", req.Amount, userID)
+	// Deliveries are checked again at dial time; this gives the caller an early error
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", u.Hostname())
 	if err != nil {
-		http.Error(w, "Transfer failed", http.StatusInternalServerError)
+		writeError(w, http.StatusBadRequest, "invalid_url", "url host could not be resolved")
 		return
 	}
+	for _, addr := range addrs {
+		if err := checkWebhookAddr(addr); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_url", "url must not point to an internal address")
+			return
+		}
+	}
 
-	// 3. Update Recipient
-	_, err = db.Exec("UPDATE users SET balance = balance + ? WHERE id = ?", req.Amount, req.ToUser)
-	if err != nil {
-		// In production, we would need a rollback mechanism here
-		log.Printf("CRITICAL: Failed to credit user %d", req.ToUser)
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		writeError(w, http.StatusInternalServerError, "secret_generation_failed", "Could not generate secret")
+		return
 	}
+	secret := "whsec_" + hex.EncodeToString(buf)
 
-	// 4. Log Transaction
-	db.Exec("INSERT INTO transactions (from_user, to_user, amount, timestamp, status) VALUES (?, ?, ?, ?, 'COMPLETED')",
-		userID, req.ToUser, req.Amount, time.Now().Format(time.RFC3339))
+	_, err = db.ExecContext(ctx, "INSERT OR REPLACE INTO webhooks (user_id, url, secret) VALUES (?, ?, ?)", userID, u.String(), secret)
+	if err != nil {
+		dbError(w, err, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"url": u.String(), "secret": secret})
 }
 
-// RefundTransaction allows a user to request a refund for a transaction they sent
-// Intention: If you sent money by mistake, you can reverse it if it's recent.
-func RefundTransaction(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+// ListWebhookDeliveries returns the caller's most recent webhook deliveries, newest first
+func ListWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed")
 		return
 	}
 	userID := r.Context().Value("user_id").(int)
 
-	type RefundReq struct {
-		TransactionID int `json:"transaction_id"`
-	}
-	var req RefundReq
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid body", http.StatusBadRequest)
-		return
+	query := "SELECT id, transaction_id, event_type, payload, status, attempts, last_error, next_attempt_at, created_at, updated_at FROM webhook_deliveries WHERE user_id = ?"
+	args := []interface{}{userID}
+	if status := r.URL.Query().Get("status"); status != "" {
+		query += " AND status = ?"
+		args = append(args, strings.ToUpper(status))
 	}
+	query += " ORDER BY id DESC LIMIT 100"
 
-	// Retrieve transaction to verify ownership
-	var fromUser, toUser int
-	var amount int64
-	var status string
+	ctx, cancel := queryContext(r)
+	defer cancel()
 
-	err := db.QueryRow("SELECT from_user, to_user, amount, status FROM transactions WHERE id = ?", req.TransactionID).Scan(&fromUser, &toUser, &amount, &status)
+	rows, err := db.QueryContext(ctx, query, args...)
 	if err != nil {
-		http.Error(w, "Transaction not found", http.StatusNotFound)
+		dbError(w, err, http.StatusInternalServerError, "database_error", "Database error")
 		return
 	}
+	defer rows.Close()
 
-	// Verify the requester is the one who originally sent the money
-	if fromUser != userID {
-		http.Error(w, "Unauthorized", http.StatusForbidden)
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		var d WebhookDelivery
+		var payload string
+		var lastError, nextAttempt sql.NullString
+		if err := rows.Scan(&d.ID, &d.TransactionID, &d.EventType, &payload, &d.Status, &d.Attempts, &lastError, &nextAttempt, &d.CreatedAt, &d.UpdatedAt); err != nil {
+			writeError(w, http.StatusInternalServerError, "database_error", "Database error")
+			return
+		}
+		d.Payload = json.RawMessage(payload)
+		d.LastError = lastError.String
+		if d.Status == "PENDING" {
+			d.NextAttemptAt = nextAttempt.String
+		}
+		deliveries = append(deliveries, d)
+	}
+	if err := rows.Err(); err != nil {
+		dbError(w, err, http.StatusInternalServerError, "database_error", "Database error")
 		return
 	}
 
-	// Logic: Reverse the money flow
-	// Deduct from recipient
-	_, err = db.Exec("UPDATE users SET balance = balance - ? WHERE id = ?", amount, toUser)
-	// Credit original sender
-	_, err = db.Exec("UPDATE users SET balance = balance + ? WHERE id = ?", amount, fromUser)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deliveries)
+}
 
-	// Update Status
-	// Note: We update the status to prevent future confusion in UI
-	db.Exec("UPDATE transactions SET status = 'REFUNDED' WHERE id = ?", req.TransactionID)
+// enqueueWebhook queues the event for the recipient's webhook, if they have one.
+// It runs inside the caller's transaction so the delivery commits with the transfer.
+func enqueueWebhook(ctx context.Context, tx *sql.Tx, ev TransferEvent) error {
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	_, err = tx.ExecContext(ctx, `INSERT INTO webhook_deliveries (user_id, transaction_id, event_type, payload, status, attempts, next_attempt_at, created_at, updated_at)
+		SELECT user_id, ?, ?, ?, 'PENDING', 0, ?, ?, ? FROM webhooks WHERE user_id = ?`,
+		ev.TransactionID, ev.Type, string(payload), now, now, now, ev.ToUser)
+	return err
+}
 
-	json.NewEncoder(w).Encode(map[string]string{"status": "refunded"})
+// wakeWebhookWorker asks the worker to look for due deliveries now instead of at the next poll
+func wakeWebhookWorker() {
+	select {
+	case webhookWake <- struct{}{}:
+	default: // A wake-up is already pending
+	}
 }
 
-// GetStatement exports transaction history for reporting
-func GetStatement(w http.ResponseWriter, r *http.Request) {
-	// Intention: Admin or User requests a statement.
-	// We support filtering by account_id for flexibility.
-	targetAccountID := r.URL.Query().Get("account_id")
+// runWebhookWorker delivers due webhooks until ctx is cancelled. Deliveries still
+// PENDING at shutdown stay in the table and are picked up on the next start.
+func runWebhookWorker(ctx context.Context) {
+	ticker := time.NewTicker(WebhookPollInterval)
+	defer ticker.Stop()
+	for {
+		processDueDeliveries(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-webhookWake:
+		}
+	}
+}
 
-	if targetAccountID == "" {
-		http.Error(w, "account_id required", http.StatusBadRequest)
-		return
+func processDueDeliveries(ctx context.Context) {
+	type due struct {
+		id, userID, attempts int
+		payload              string
 	}
 
-	// Query transactions
-	rows, err := db.Query("SELECT id, amount, status FROM transactions WHERE from_user = ?", targetAccountID)
+	rows, err := db.QueryContext(ctx, "SELECT id, user_id, attempts, payload FROM webhook_deliveries WHERE status = 'PENDING' AND next_attempt_at <= ? ORDER BY next_attempt_at LIMIT ?",
+		time.Now().UTC().Format(time.RFC3339), webhookBatchSize)
 	if err != nil {
-		http.Error(w, "Db error", http.StatusInternalServerError)
+		if ctx.Err() == nil {
+			log.Printf("Loading webhook deliveries: %v", err)
+		}
 		return
 	}
-	defer rows.Close()
-
-	var txns []Transaction
+	var batch []due
 	for rows.Next() {
-		var t Transaction
-		// Filling partial struct for the report
-		if err := rows.Scan(&t.ID, &t.Amount, &t.Status); err != nil {
-			continue
+		var d due
+		if err := rows.Scan(&d.id, &d.userID, &d.attempts, &d.payload); err != nil {
+			log.Printf("Loading webhook deliveries: %v", err)
+			break
 		}
-		txns = append(txns, t)
+		batch = append(batch, d)
 	}
+	rows.Close()
 
-	json.NewEncoder(w).Encode(txns)
+	for _, d := range batch {
+		if ctx.Err() != nil {
+			return
+		}
+		deliveryErr := deliverWebhook(ctx, d.userID, []byte(d.payload))
+		if ctx.Err() != nil {
+			return // Interrupted by shutdown; don't count it as an attempt
+		}
+		if err := recordDeliveryAttempt(d.id, d.attempts+1, deliveryErr); err != nil {
+			log.Printf("Recording webhook delivery %d: %v", d.id, err)
+		}
+	}
+}
+
+// recordDeliveryAttempt stores the outcome of an attempt and schedules the next retry
+func recordDeliveryAttempt(id, attempts int, deliveryErr error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), QueryTimeout)
+	defer cancel()
+
+	now := time.Now().UTC()
+	if deliveryErr == nil {
+		_, err := db.ExecContext(ctx, "UPDATE webhook_deliveries SET status = 'DELIVERED', attempts = ?, last_error = NULL, updated_at = ? WHERE id = ?",
+			attempts, now.Format(time.RFC3339), id)
+		return err
+	}
+
+	status := "PENDING"
+	if attempts >= WebhookMaxAttempts {
+		status = "FAILED"
+		log.Printf("Webhook delivery %d failed after %d attempts: %v", id, attempts, deliveryErr)
+	}
+	next := now.Add(WebhookBaseDelay << (2 * (attempts - 1)))
+	_, err := db.ExecContext(ctx, "UPDATE webhook_deliveries SET status = ?, attempts = ?, last_error = ?, next_attempt_at = ?, updated_at = ? WHERE id = ?",
+		status, attempts, deliveryErr.Error(), next.Format(time.RFC3339), now.Format(time.RFC3339), id)
+	return err
+}
+
+// deliverWebhook POSTs the payload to the user's current webhook URL, signed with its secret
+func deliverWebhook(ctx context.Context, userID int, payload []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, WebhookTimeout)
+	defer cancel()
+
+	var hookURL, secret string
+	err := db.QueryRowContext(ctx, "SELECT url, secret FROM webhooks WHERE user_id = ?", userID).Scan(&hookURL, &secret)
+	if errors.Is(err, sql.ErrNoRows) {
+		return errors.New("webhook no longer registered")
+	}
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", hookURL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Signature", signWebhook(secret, payload))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("endpoint returned %s", resp.Status)
+	}
+	return nil
+}
+
+// signWebhook returns the hex HMAC-SHA256 of the body, keyed with the webhook secret
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
 }
 
 func main() {
-	initDB()
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	RefundWindow = cfg.RefundWindow
+	DailyTransferLimit = cfg.DailyLimit
+	TransferBounds = cfg.TransferBounds
+	Fees, FeeCollectorID, RefundFees = cfg.Fees, cfg.FeeCollector, cfg.RefundFees
+
+	initDB(cfg.DBPath)
 	mux := http.NewServeMux()
 
 	// Register Routes
-	mux.HandleFunc("/api/balance", AuthMiddleware(GetBalance))
-	mux.HandleFunc("/api/transfer", AuthMiddleware(TransferHandler))
-	mux.HandleFunc("/api/refund", AuthMiddleware(RefundTransaction))
-	mux.HandleFunc("/api/statement", AuthMiddleware(GetStatement))
-
-	fmt.Println("Ledger Service running on :8080")
-	log.Fatal(http.ListenAndServe(":8080", mux))
-}
\ No newline at end of file
+	mux.HandleFunc("/healthz", HealthHandler)
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/api/balance", Authenticated(GetBalance))
+	mux.HandleFunc("GET /api/balance/history", Authenticated(GetBalanceHistory))
+	mux.HandleFunc("/api/transfer", Authenticated(MetricsMiddleware(transfersTotal, transferDuration, TransferHandler)))
+	mux.HandleFunc("/api/bulk-transfer", Authenticated(MetricsMiddleware(bulkTransfersTotal, nil, BulkTransfer)))
+	mux.HandleFunc("/api/refund", Authenticated(MetricsMiddleware(refundsTotal, nil, RefundTransaction)))
+	mux.HandleFunc("/api/hold", Authenticated(HoldFunds))
+	mux.HandleFunc("/api/capture", Authenticated(MetricsMiddleware(holdCapturesTotal, nil, CaptureHold)))
+	mux.HandleFunc("/api/release", Authenticated(ReleaseHold))
+	mux.HandleFunc("/api/statement", Authenticated(GetStatement))
+	mux.HandleFunc("GET /api/transactions", Authenticated(SearchTransactions))
+	mux.HandleFunc("GET /api/transactions/{id}", Authenticated(GetTransaction))
+	mux.HandleFunc("/api/users", Authenticated(AdminMiddleware(CreateUser)))
+	mux.HandleFunc("GET /api/users/{id}", Authenticated(AdminMiddleware(GetUser)))
+	mux.HandleFunc("/api/rotate-key", Authenticated(RotateAPIKey))
+	mux.HandleFunc("/api/webhooks", Authenticated(RegisterWebhook))
+	mux.HandleFunc("/api/webhooks/deliveries", Authenticated(ListWebhookDeliveries))
+	mux.HandleFunc("/api/admin/freeze", Authenticated(AdminMiddleware(FreezeAccount)))
+	mux.HandleFunc("/api/admin/unfreeze", Authenticated(AdminMiddleware(UnfreezeAccount)))
+	mux.HandleFunc("/api/admin/reconcile", Authenticated(AdminMiddleware(Reconcile)))
+
+	handler := CORSMiddleware(cfg.CORSOrigins, mux.ServeHTTP)
+	if cfg.TLSEnabled() {
+		handler = HSTSMiddleware(handler)
+	}
+	srv := &http.Server{
+		Addr:    cfg.Addr,
+		Handler: handler,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	webhookWG.Add(1)
+	go func() {
+		defer webhookWG.Done()
+		runWebhookWorker(ctx)
+	}()
+
+	go func() {
+		var err error
+		if cfg.TLSEnabled() {
+			fmt.Println("Ledger Service running on " + cfg.Addr + " (HTTPS)")
+			err = srv.ListenAndServeTLS(cfg.TLSCert, cfg.TLSKey)
+		} else {
+			log.Println("WARNING: serving plain HTTP, API keys are sent unencrypted. Set LEDGER_TLS_CERT and LEDGER_TLS_KEY to enable HTTPS.")
+			fmt.Println("Ledger Service running on " + cfg.Addr)
+			err = srv.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	<-ctx.Done()
+	log.Println("Shutting down, waiting for in-flight requests")
+
+	// Shutdown stops accepting connections and lets running transfers (including
+	// their fraud check) commit before the database is closed underneath them.
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Shutdown: %v", err)
+	}
+	// The worker stops with ctx; wait for its current attempt before closing the database
+	webhookWG.Wait()
+	if err := db.Close(); err != nil {
+		log.Printf("Closing database: %v", err)
+	}
+}
@@ -0,0 +1,786 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/time/rate"
+)
+
+// --- TEST HELPERS ---
+
+// Seeded accounts created by initDB, in insertion order
+const (
+	aliceID   = 1 // 10000, secret_alice_123
+	bobID     = 2 // 5000, secret_bob_456
+	malloryID = 3 // 1000, secret_mal_789
+	supportID = 4 // admin, secret_support_000
+
+	aliceKey   = "secret_alice_123"
+	bobKey     = "secret_bob_456"
+	malloryKey = "secret_mal_789"
+	supportKey = "secret_support_000"
+)
+
+// newTestDB opens a fresh seeded database in a temp directory
+func newTestDB(t testing.TB) {
+	t.Helper()
+	initDB(filepath.Join(t.TempDir(), "ledger.db"))
+	t.Cleanup(func() { db.Close() })
+}
+
+// withFees installs a fee schedule collected by the support account for the test
+func withFees(t testing.TB, fees FeeSchedule) {
+	t.Helper()
+	saved, savedCollector := Fees, FeeCollectorID
+	Fees, FeeCollectorID = fees, supportID
+	t.Cleanup(func() { Fees, FeeCollectorID = saved, savedCollector })
+}
+
+// call sends a JSON POST through AuthMiddleware as the holder of apiKey
+func call(t testing.TB, handler http.HandlerFunc, apiKey, target, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest("POST", target, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("X-API-Key", apiKey)
+	w := httptest.NewRecorder()
+	AuthMiddleware(handler)(w, r)
+	return w
+}
+
+// get sends a GET through AuthMiddleware as the holder of apiKey
+func get(t testing.TB, handler http.HandlerFunc, apiKey, target string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest("GET", target, nil)
+	r.Header.Set("X-API-Key", apiKey)
+	w := httptest.NewRecorder()
+	AuthMiddleware(handler)(w, r)
+	return w
+}
+
+// assertReconciled fails the test if Reconcile finds any discrepancy
+func assertReconciled(t testing.TB) {
+	t.Helper()
+	w := get(t, Reconcile, supportKey, "/api/admin/reconcile")
+	if w.Code != http.StatusOK || decode(t, w)["balanced"] != true {
+		t.Fatalf("ledger does not reconcile: %d %s", w.Code, w.Body.String())
+	}
+}
+
+// decode unmarshals a response body into a map
+func decode(t testing.TB, w *httptest.ResponseRecorder) map[string]interface{} {
+	t.Helper()
+	var body map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decoding %q: %v", w.Body.String(), err)
+	}
+	return body
+}
+
+// errorCode returns the code of a writeError response
+func errorCode(t testing.TB, w *httptest.ResponseRecorder) string {
+	t.Helper()
+	e, _ := decode(t, w)["error"].(map[string]interface{})
+	code, _ := e["code"].(string)
+	return code
+}
+
+// balanceOf reads a user's balance straight from the database
+func balanceOf(t testing.TB, id int) int64 {
+	t.Helper()
+	var balance int64
+	if err := db.QueryRow("SELECT balance FROM users WHERE id = ?", id).Scan(&balance); err != nil {
+		t.Fatal(err)
+	}
+	return balance
+}
+
+// countRows counts transactions matching a WHERE clause
+func countRows(t testing.TB, where string, args ...interface{}) int {
+	t.Helper()
+	var n int
+	if err := db.QueryRow("SELECT COUNT(*) FROM transactions WHERE "+where, args...).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// --- FEES ---
+
+func TestBulkTransferChargesFeePerItem(t *testing.T) {
+	newTestDB(t)
+	withFees(t, FeeSchedule{Flat: 10})
+
+	w := call(t, BulkTransfer, aliceKey, "/api/bulk-transfer", `{"transfers":[{"to_user":2,"amount":100},{"to_user":3,"amount":200}]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body.String())
+	}
+	if got, want := balanceOf(t, aliceID), int64(10000-300-20); got != want {
+		t.Errorf("alice balance %d, want %d", got, want)
+	}
+	if got := balanceOf(t, supportID); got != 20 {
+		t.Errorf("collector balance %d, want 20", got)
+	}
+	if n := countRows(t, "status = 'FEE' AND from_user = ? AND parent_transaction_id IS NOT NULL", aliceID); n != 2 {
+		t.Errorf("%d FEE rows, want 2", n)
+	}
+	assertReconciled(t)
+}
+
+func TestBulkTransferFeeCountsTowardFunds(t *testing.T) {
+	newTestDB(t)
+	withFees(t, FeeSchedule{Flat: 10})
+
+	// Mallory has exactly the amount but not the fee
+	w := call(t, BulkTransfer, malloryKey, "/api/bulk-transfer", `{"transfers":[{"to_user":2,"amount":1000}]}`)
+	if w.Code != http.StatusBadRequest || errorCode(t, w) != "insufficient_funds" {
+		t.Fatalf("status %d: %s", w.Code, w.Body.String())
+	}
+	if got := balanceOf(t, malloryID); got != 1000 {
+		t.Errorf("mallory balance %d, want 1000", got)
+	}
+}
+
+func TestCaptureHoldChargesFee(t *testing.T) {
+	newTestDB(t)
+	withFees(t, FeeSchedule{Flat: 10})
+
+	w := call(t, HoldFunds, aliceKey, "/api/hold", `{"to_user":2,"amount":500}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("hold status %d: %s", w.Code, w.Body.String())
+	}
+	holdID := int(decode(t, w)["transaction_id"].(float64))
+
+	w = call(t, CaptureHold, aliceKey, "/api/capture", `{"transaction_id":`+strconv.Itoa(holdID)+`}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("capture status %d: %s", w.Code, w.Body.String())
+	}
+	if got, want := balanceOf(t, aliceID), int64(10000-500-10); got != want {
+		t.Errorf("alice balance %d, want %d", got, want)
+	}
+	if got := balanceOf(t, bobID); got != 5500 {
+		t.Errorf("bob balance %d, want 5500", got)
+	}
+	if got := balanceOf(t, supportID); got != 10 {
+		t.Errorf("collector balance %d, want 10", got)
+	}
+	if n := countRows(t, "status = 'FEE' AND parent_transaction_id = ?", holdID); n != 1 {
+		t.Errorf("%d FEE rows for the hold, want 1", n)
+	}
+	assertReconciled(t)
+}
+
+func TestReleaseHoldChargesNoFee(t *testing.T) {
+	newTestDB(t)
+	withFees(t, FeeSchedule{Flat: 10})
+
+	w := call(t, HoldFunds, aliceKey, "/api/hold", `{"to_user":2,"amount":500}`)
+	holdID := int(decode(t, w)["transaction_id"].(float64))
+	if w = call(t, ReleaseHold, aliceKey, "/api/release", `{"transaction_id":`+strconv.Itoa(holdID)+`}`); w.Code != http.StatusOK {
+		t.Fatalf("release status %d: %s", w.Code, w.Body.String())
+	}
+	if got := balanceOf(t, aliceID); got != 10000 {
+		t.Errorf("alice balance %d, want 10000", got)
+	}
+}
+
+// --- REFUNDS ---
+
+// transfer sends amount from the holder of apiKey to toUser and returns the new transaction's ID
+func transfer(t testing.TB, apiKey string, toUser int, amount int64) int {
+	t.Helper()
+	w := call(t, TransferHandler, apiKey, "/api/transfer", fmt.Sprintf(`{"to_user":%d,"amount":%d}`, toUser, amount))
+	if w.Code != http.StatusOK {
+		t.Fatalf("transfer status %d: %s", w.Code, w.Body.String())
+	}
+	var id int
+	if err := db.QueryRow("SELECT MAX(id) FROM transactions WHERE status = 'COMPLETED'").Scan(&id); err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+// refund asks to refund txnID as the holder of apiKey
+func refund(t testing.TB, apiKey string, txnID int) *httptest.ResponseRecorder {
+	t.Helper()
+	return call(t, RefundTransaction, apiKey, "/api/refund", fmt.Sprintf(`{"transaction_id":%d}`, txnID))
+}
+
+func TestRefundTwiceRejected(t *testing.T) {
+	newTestDB(t)
+	txnID := transfer(t, aliceKey, bobID, 700)
+
+	if w := refund(t, aliceKey, txnID); w.Code != http.StatusOK {
+		t.Fatalf("first refund status %d: %s", w.Code, w.Body.String())
+	}
+	w := refund(t, aliceKey, txnID)
+	if w.Code != http.StatusConflict || errorCode(t, w) != "not_refundable" {
+		t.Fatalf("second refund status %d: %s", w.Code, w.Body.String())
+	}
+
+	if got := balanceOf(t, aliceID); got != 10000 {
+		t.Errorf("alice balance %d, want 10000", got)
+	}
+	if got := balanceOf(t, bobID); got != 5000 {
+		t.Errorf("bob balance %d, want 5000", got)
+	}
+	if n := countRows(t, "status = 'REVERSAL' AND refund_transaction_id = ?", txnID); n != 1 {
+		t.Errorf("%d REVERSAL rows, want 1", n)
+	}
+	assertReconciled(t)
+}
+
+// failBalanceUpdates makes every later balance UPDATE on user id fail with an error
+func failBalanceUpdates(t testing.TB, id int) {
+	t.Helper()
+	_, err := db.Exec(fmt.Sprintf(`CREATE TRIGGER fail_balance_%d BEFORE UPDATE OF balance ON users
+		WHEN NEW.id = %d BEGIN SELECT RAISE(ABORT, 'forced failure'); END`, id, id))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRefundAbortsWhenBalanceUpdateFails(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		failID int
+	}{
+		{"recipient debit", bobID},
+		{"sender credit", aliceID},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			newTestDB(t)
+			txnID := transfer(t, aliceKey, bobID, 700)
+			failBalanceUpdates(t, tc.failID)
+
+			if w := refund(t, aliceKey, txnID); w.Code != http.StatusInternalServerError {
+				t.Fatalf("refund status %d: %s", w.Code, w.Body.String())
+			}
+			if n := countRows(t, "id = ? AND status = 'COMPLETED'", txnID); n != 1 {
+				t.Error("transaction status changed by a failed refund")
+			}
+			if n := countRows(t, "status = 'REVERSAL'"); n != 0 {
+				t.Errorf("%d REVERSAL rows after a failed refund", n)
+			}
+			if got := balanceOf(t, aliceID); got != 9300 {
+				t.Errorf("alice balance %d, want 9300", got)
+			}
+			if got := balanceOf(t, bobID); got != 5700 {
+				t.Errorf("bob balance %d, want 5700", got)
+			}
+		})
+	}
+}
+
+// refundedBy reads the audit column of a transaction
+func refundedBy(t testing.TB, txnID int) int {
+	t.Helper()
+	var by sql.NullInt64
+	if err := db.QueryRow("SELECT refunded_by FROM transactions WHERE id = ?", txnID).Scan(&by); err != nil {
+		t.Fatal(err)
+	}
+	return int(by.Int64)
+}
+
+func TestAdminRefundIsAudited(t *testing.T) {
+	newTestDB(t)
+	txnID := transfer(t, aliceKey, bobID, 700)
+
+	if w := refund(t, supportKey, txnID); w.Code != http.StatusOK {
+		t.Fatalf("admin refund status %d: %s", w.Code, w.Body.String())
+	}
+	if got := refundedBy(t, txnID); got != supportID {
+		t.Errorf("refunded_by %d, want %d", got, supportID)
+	}
+	if got := balanceOf(t, aliceID); got != 10000 {
+		t.Errorf("alice balance %d, want 10000", got)
+	}
+	assertReconciled(t)
+}
+
+func TestThirdPartyRefundForbidden(t *testing.T) {
+	newTestDB(t)
+	txnID := transfer(t, aliceKey, bobID, 700)
+
+	w := refund(t, malloryKey, txnID)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("third-party refund status %d: %s", w.Code, w.Body.String())
+	}
+	if n := countRows(t, "id = ? AND status = 'COMPLETED' AND refunded_by IS NULL", txnID); n != 1 {
+		t.Error("transaction changed after a forbidden refund")
+	}
+	if got := balanceOf(t, bobID); got != 5700 {
+		t.Errorf("bob balance %d, want 5700", got)
+	}
+}
+
+// --- DRY RUN ---
+
+func TestDryRunTransferChangesNothing(t *testing.T) {
+	newTestDB(t)
+	withFees(t, FeeSchedule{Flat: 10})
+
+	w := call(t, TransferHandler, aliceKey, "/api/transfer?dry_run=true", fmt.Sprintf(`{"to_user":%d,"amount":700}`, bobID))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body.String())
+	}
+	body := decode(t, w)
+	if body["would_succeed"] != true || body["resulting_balance"] != float64(10000-700-10) {
+		t.Fatalf("dry run response %v", body)
+	}
+
+	w = call(t, TransferHandler, malloryKey, "/api/transfer?dry_run=true", fmt.Sprintf(`{"to_user":%d,"amount":5000}`, bobID))
+	if body := decode(t, w); w.Code != http.StatusOK || body["would_succeed"] != false || body["resulting_balance"] != float64(1000) {
+		t.Fatalf("insufficient dry run: status %d %v", w.Code, body)
+	}
+
+	for id, want := range map[int]int64{aliceID: 10000, bobID: 5000, malloryID: 1000, supportID: 0} {
+		if got := balanceOf(t, id); got != want {
+			t.Errorf("user %d balance %d, want %d", id, got, want)
+		}
+	}
+	if n := countRows(t, "1 = 1"); n != 0 {
+		t.Errorf("%d transactions recorded by dry runs", n)
+	}
+}
+
+// --- RATE LIMITING ---
+
+// withRateLimit installs a rate limit and a fresh set of buckets for the test
+func withRateLimit(t testing.TB, limit rate.Limit, burst int) {
+	t.Helper()
+	savedLimit, savedBurst := RateLimit, RateBurst
+	RateLimit, RateBurst = limit, burst
+	resetLimiters()
+	t.Cleanup(func() {
+		RateLimit, RateBurst = savedLimit, savedBurst
+		resetLimiters()
+	})
+}
+
+func resetLimiters() {
+	limiters.Range(func(k, _ interface{}) bool {
+		limiters.Delete(k)
+		return true
+	})
+	limiterCount.Store(0)
+}
+
+// getLimited sends a GET /api/balance through the full authenticated chain
+func getLimited(apiKey string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", "/api/balance", nil)
+	r.Header.Set("X-API-Key", apiKey)
+	w := httptest.NewRecorder()
+	Authenticated(GetBalance)(w, r)
+	return w
+}
+
+func TestRateLimitPerUser(t *testing.T) {
+	newTestDB(t)
+	withRateLimit(t, rate.Every(time.Hour), 2)
+
+	for i := 0; i < 2; i++ {
+		if w := getLimited(aliceKey); w.Code != http.StatusOK {
+			t.Fatalf("request %d: status %d", i+1, w.Code)
+		}
+	}
+	w := getLimited(aliceKey)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("over the limit: status %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	if w := getLimited(bobKey); w.Code != http.StatusOK {
+		t.Fatalf("another user was throttled: status %d", w.Code)
+	}
+}
+
+func TestRateLimitThrottlesUnknownKeys(t *testing.T) {
+	newTestDB(t)
+	withRateLimit(t, rate.Every(time.Hour), 2)
+
+	for i := 0; i < 2; i++ {
+		if w := getLimited("random-key"); w.Code != http.StatusUnauthorized {
+			t.Fatalf("unknown key: status %d", w.Code)
+		}
+	}
+	// Throttled before AuthMiddleware, so the key is never looked up
+	db.Close()
+	if w := getLimited("random-key"); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("unknown key over the limit: status %d", w.Code)
+	}
+	if w := getLimited(""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("missing key: status %d", w.Code)
+	}
+}
+
+func TestRateLimitEvictsIdleBuckets(t *testing.T) {
+	withRateLimit(t, 10, 20)
+	now := time.Now()
+	for i := 0; i <= maxLimiters; i++ {
+		limiterFor(strconv.Itoa(i), now.Add(-time.Hour))
+	}
+	limiterFor("active", now)
+
+	if n := limiterCount.Load(); n != 1 {
+		t.Fatalf("%d buckets after eviction, want 1", n)
+	}
+}
+
+// --- WEBHOOKS ---
+
+func TestRegisterWebhookRejectsInternalAddresses(t *testing.T) {
+	newTestDB(t)
+	for _, u := range []string{
+		"http://127.0.0.1/hook",
+		"http://localhost:8080/hook",
+		"http://[::1]/hook",
+		"http://10.0.0.5/hook",
+		"http://172.16.0.1/hook",
+		"http://192.168.1.1/hook",
+		"http://169.254.169.254/latest/meta-data",
+		"http://[fe80::1]/hook",
+		"http://0.0.0.0/hook",
+		"http://[::ffff:127.0.0.1]/hook",
+	} {
+		w := call(t, RegisterWebhook, aliceKey, "/api/webhooks", `{"url":"`+u+`"}`)
+		if w.Code != http.StatusBadRequest || errorCode(t, w) != "invalid_url" {
+			t.Errorf("%s: status %d: %s", u, w.Code, w.Body.String())
+		}
+	}
+
+	if w := call(t, RegisterWebhook, aliceKey, "/api/webhooks", `{"url":"https://203.0.113.10/hook"}`); w.Code != http.StatusCreated {
+		t.Fatalf("public address: status %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestDeliverWebhookRefusesInternalAddressAtDial(t *testing.T) {
+	newTestDB(t)
+	hit := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { hit = true }))
+	defer srv.Close()
+
+	// Stored directly, as if the name had resolved to a public address at registration
+	if _, err := db.Exec("INSERT INTO webhooks (user_id, url, secret) VALUES (?, ?, 'whsec_test')", bobID, srv.URL); err != nil {
+		t.Fatal(err)
+	}
+	err := deliverWebhook(context.Background(), bobID, []byte(`{}`))
+	if !errors.Is(err, errInternalAddress) {
+		t.Fatalf("deliverWebhook = %v, want errInternalAddress", err)
+	}
+	if hit {
+		t.Fatal("request reached the internal server")
+	}
+}
+
+// --- CONCURRENCY ---
+
+// concurrently runs fn n times at once and returns the recorded responses
+func concurrently(n int, fn func(i int) *httptest.ResponseRecorder) []*httptest.ResponseRecorder {
+	results := make([]*httptest.ResponseRecorder, n)
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			results[i] = fn(i)
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+	return results
+}
+
+func TestConcurrentTransfersDoNotLock(t *testing.T) {
+	newTestDB(t)
+	keys := []string{aliceKey, bobKey, malloryKey}
+	ids := []int{aliceID, bobID, malloryID}
+
+	results := concurrently(20, func(i int) *httptest.ResponseRecorder {
+		to := ids[(i+1)%3]
+		return call(t, TransferHandler, keys[i%3], "/api/transfer", fmt.Sprintf(`{"to_user":%d,"amount":10}`, to))
+	})
+	for i, w := range results {
+		if w.Code != http.StatusOK {
+			t.Errorf("transfer %d: status %d: %s", i, w.Code, w.Body.String())
+		}
+		if strings.Contains(w.Body.String(), "locked") {
+			t.Errorf("transfer %d: %s", i, w.Body.String())
+		}
+	}
+	if n := countRows(t, "status = 'COMPLETED'"); n != 20 {
+		t.Errorf("%d completed transfers, want 20", n)
+	}
+	assertReconciled(t)
+}
+
+func TestConcurrentTransfersNeverOverspend(t *testing.T) {
+	newTestDB(t)
+
+	// Mallory's 1000 covers exactly 10 of these
+	results := concurrently(30, func(int) *httptest.ResponseRecorder {
+		return call(t, TransferHandler, malloryKey, "/api/transfer", fmt.Sprintf(`{"to_user":%d,"amount":100}`, bobID))
+	})
+	ok := 0
+	for i, w := range results {
+		switch {
+		case w.Code == http.StatusOK:
+			ok++
+		case w.Code != http.StatusBadRequest || errorCode(t, w) != "insufficient_funds":
+			t.Errorf("transfer %d: status %d: %s", i, w.Code, w.Body.String())
+		}
+	}
+	if ok != 10 {
+		t.Errorf("%d transfers succeeded, want 10", ok)
+	}
+	if got := balanceOf(t, malloryID); got != 0 {
+		t.Errorf("mallory balance %d, want 0", got)
+	}
+	if got := balanceOf(t, bobID); got != 6000 {
+		t.Errorf("bob balance %d, want 6000", got)
+	}
+	assertReconciled(t)
+}
+
+func TestConcurrentTransfersLoseNoUpdates(t *testing.T) {
+	newTestDB(t)
+
+	// Alice and Bob pay each other at the same time; every write must land
+	results := concurrently(40, func(i int) *httptest.ResponseRecorder {
+		if i%2 == 0 {
+			return call(t, TransferHandler, aliceKey, "/api/transfer", fmt.Sprintf(`{"to_user":%d,"amount":30}`, bobID))
+		}
+		return call(t, TransferHandler, bobKey, "/api/transfer", fmt.Sprintf(`{"to_user":%d,"amount":10}`, aliceID))
+	})
+	for i, w := range results {
+		if w.Code != http.StatusOK {
+			t.Fatalf("transfer %d: status %d: %s", i, w.Code, w.Body.String())
+		}
+	}
+	if got, want := balanceOf(t, aliceID), int64(10000-20*30+20*10); got != want {
+		t.Errorf("alice balance %d, want %d", got, want)
+	}
+	if got, want := balanceOf(t, bobID), int64(5000+20*30-20*10); got != want {
+		t.Errorf("bob balance %d, want %d", got, want)
+	}
+	for _, id := range []int{aliceID, bobID} {
+		var version int
+		if err := db.QueryRow("SELECT version FROM users WHERE id = ?", id).Scan(&version); err != nil {
+			t.Fatal(err)
+		}
+		if version != 40 {
+			t.Errorf("user %d version %d, want 40", id, version)
+		}
+	}
+	assertReconciled(t)
+}
+
+// countingFraudChecker allows every transfer and counts the checks for one amount
+type countingFraudChecker struct {
+	amount int64
+	mu     sync.Mutex
+	calls  int
+}
+
+func (c *countingFraudChecker) Check(ctx context.Context, from, to int, amount int64) (bool, error) {
+	if amount == c.amount {
+		c.mu.Lock()
+		c.calls++
+		c.mu.Unlock()
+	}
+	return true, nil
+}
+
+func TestConcurrentVersionConflictRetriesThen409(t *testing.T) {
+	newTestDB(t)
+	fraud := &countingFraudChecker{amount: 13}
+	saved := fraudChecker
+	fraudChecker = fraud
+	t.Cleanup(func() { fraudChecker = saved })
+
+	// Debiting Alice by 13 bumps Bob's version behind the transfer's back, so that
+	// transfer's credit always finds a stale version
+	_, err := db.Exec(fmt.Sprintf(`CREATE TRIGGER force_conflict AFTER UPDATE OF balance ON users
+		WHEN NEW.id = %d AND OLD.balance - NEW.balance = 13
+		BEGIN UPDATE users SET version = version + 1 WHERE id = %d; END`, aliceID, bobID))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results := concurrently(21, func(i int) *httptest.ResponseRecorder {
+		switch {
+		case i == 0:
+			return call(t, TransferHandler, aliceKey, "/api/transfer", fmt.Sprintf(`{"to_user":%d,"amount":13}`, bobID))
+		case i%2 == 0:
+			return call(t, TransferHandler, aliceKey, "/api/transfer", fmt.Sprintf(`{"to_user":%d,"amount":10}`, bobID))
+		default:
+			return call(t, TransferHandler, bobKey, "/api/transfer", fmt.Sprintf(`{"to_user":%d,"amount":10}`, aliceID))
+		}
+	})
+	if w := results[0]; w.Code != http.StatusConflict || errorCode(t, w) != "version_conflict" {
+		t.Fatalf("conflicting transfer: status %d: %s", w.Code, w.Body.String())
+	}
+	for i, w := range results[1:] {
+		if w.Code != http.StatusOK {
+			t.Errorf("transfer %d: status %d: %s", i+1, w.Code, w.Body.String())
+		}
+	}
+	if fraud.calls != MaxVersionRetries {
+		t.Errorf("conflicting transfer attempted %d times, want %d", fraud.calls, MaxVersionRetries)
+	}
+
+	// Only the other transfers landed: 10 each way
+	if got := balanceOf(t, aliceID); got != 10000 {
+		t.Errorf("alice balance %d, want 10000", got)
+	}
+	if got := balanceOf(t, bobID); got != 5000 {
+		t.Errorf("bob balance %d, want 5000", got)
+	}
+	if n := countRows(t, "amount = 13"); n != 0 {
+		t.Errorf("%d rows recorded for the conflicting transfer", n)
+	}
+	assertReconciled(t)
+}
+
+// --- BENCHMARKS ---
+
+// seedTransactions inserts n completed transfers spread over 1000 account IDs,
+// so each seeded user is party to about n/500 of them
+func seedTransactions(b *testing.B, n int) {
+	b.Helper()
+	_, err := db.Exec(`WITH RECURSIVE seq(i) AS (SELECT 1 UNION ALL SELECT i + 1 FROM seq WHERE i < ?)
+		INSERT INTO transactions (from_user, to_user, amount, currency, timestamp, status)
+		SELECT i % 1000 + 1, (i * 7 + 3) % 1000 + 1, 1, 'USD', '2024-01-01T00:00:00Z', 'COMPLETED' FROM seq`, n)
+	if err != nil {
+		b.Fatal(err)
+	}
+}
+
+func BenchmarkStatementLookup(b *testing.B) {
+	for _, indexed := range []bool{true, false} {
+		name := "indexed"
+		if !indexed {
+			name = "unindexed"
+		}
+		b.Run(name, func(b *testing.B) {
+			newTestDB(b)
+			seedTransactions(b, 100000)
+			if !indexed {
+				if _, err := db.Exec("DROP INDEX idx_txn_from; DROP INDEX idx_txn_to"); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if w := get(b, GetStatement, aliceKey, "/api/statement?account_id=1"); w.Code != http.StatusOK {
+					b.Fatalf("status %d: %s", w.Code, w.Body.String())
+				}
+			}
+		})
+	}
+}
+
+// seedUsers inserts n users with random API key hashes, except the last, whose
+// key is lastKey. The lookup stops at the first match, so only a key near the end
+// of the table shows what a scan costs.
+func seedUsers(b *testing.B, n int, lastKey string) {
+	b.Helper()
+	_, err := db.Exec(`WITH RECURSIVE seq(i) AS (SELECT 1 UNION ALL SELECT i + 1 FROM seq WHERE i < ?)
+		INSERT INTO users (username, balance, opening_balance, currency, api_key_hash)
+		SELECT 'seed' || i, 0, 0, 'USD', CASE WHEN i = ? THEN ? ELSE lower(hex(randomblob(32))) END FROM seq`, n, n, hashAPIKey(lastKey))
+	if err != nil {
+		b.Fatal(err)
+	}
+}
+
+func BenchmarkAuthLookup(b *testing.B) {
+	for _, indexed := range []bool{true, false} {
+		name := "indexed"
+		if !indexed {
+			name = "unindexed"
+		}
+		b.Run(name, func(b *testing.B) {
+			newTestDB(b)
+			seedUsers(b, 100000, "bench-key")
+			if !indexed {
+				if _, err := db.Exec("DROP INDEX idx_users_api_key_hash"); err != nil {
+					b.Fatal(err)
+				}
+			}
+			noop := func(http.ResponseWriter, *http.Request) {}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if w := get(b, noop, "bench-key", "/api/balance"); w.Code != http.StatusOK {
+					b.Fatalf("status %d: %s", w.Code, w.Body.String())
+				}
+			}
+		})
+	}
+}
+
+// --- METRICS ---
+
+func TestMoneySupplyByCurrency(t *testing.T) {
+	newTestDB(t)
+	if _, err := db.Exec("INSERT INTO users (username, balance, opening_balance, currency) VALUES ('eve', 2500, 2500, 'EUR')"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `# HELP ledger_money_supply Sum of all user balances by currency, in minor units.
+# TYPE ledger_money_supply gauge
+ledger_money_supply{currency="EUR"} 2500
+ledger_money_supply{currency="USD"} 16000
+`
+	if err := testutil.CollectAndCompare(moneySupply, strings.NewReader(want)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMetricsCountOnlyAuthenticatedRequests(t *testing.T) {
+	newTestDB(t)
+	count := func(c *prometheus.CounterVec, outcome string) float64 {
+		return testutil.ToFloat64(c.WithLabelValues(outcome))
+	}
+	rejected := count(transfersTotal, "rejected")
+	bulk := count(bulkTransfersTotal, "success")
+	captures := count(holdCapturesTotal, "success")
+
+	transfer := MetricsMiddleware(transfersTotal, transferDuration, TransferHandler)
+	if w := call(t, transfer, "bogus-key", "/api/transfer", `{"to_user":2,"amount":100}`); w.Code != http.StatusUnauthorized {
+		t.Fatalf("bogus key: status %d", w.Code)
+	}
+	if got := count(transfersTotal, "rejected"); got != rejected {
+		t.Error("auth failure counted as a rejected transfer")
+	}
+
+	w := call(t, MetricsMiddleware(bulkTransfersTotal, nil, BulkTransfer), aliceKey, "/api/bulk-transfer", `{"transfers":[{"to_user":2,"amount":100}]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("bulk transfer status %d: %s", w.Code, w.Body.String())
+	}
+	if got := count(bulkTransfersTotal, "success"); got != bulk+1 {
+		t.Errorf("bulk transfer successes %v, want %v", got, bulk+1)
+	}
+
+	w = call(t, HoldFunds, aliceKey, "/api/hold", `{"to_user":2,"amount":500}`)
+	holdID := int(decode(t, w)["transaction_id"].(float64))
+	w = call(t, MetricsMiddleware(holdCapturesTotal, nil, CaptureHold), aliceKey, "/api/capture", `{"transaction_id":`+strconv.Itoa(holdID)+`}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("capture status %d: %s", w.Code, w.Body.String())
+	}
+	if got := count(holdCapturesTotal, "success"); got != captures+1 {
+		t.Errorf("hold capture successes %v, want %v", got, captures+1)
+	}
+}